@@ -3,11 +3,13 @@ package main
 import (
   "bufio"
   "fmt"
+  "net"
   "net/rpc"
   "os"
   "strings"
   "log"
   "sync"
+  "time"
 
 )
 
@@ -37,12 +39,43 @@ const (
 	  COMM_QUITCHAT + " - quits the chat client.\n" 
 	  
 	MESS_DISC = "Goodbye, disconnect.\n"
+	MESS_NAMEUSED = "The name %s is already being used.\n"
+
+	/*Default name, and the name the server uses for its own notes.*/
+	CNAME = "Anon"
+	SNAME = "MyServer"
+
+	/*Exception names from chat.idl, the server errors carry these as text.*/
+	ERR_NAMEUSED = "NameAlreadyUsed"
 )
 type Args struct {
     Token string
     String string
 }
 
+type JoinArgs struct {
+    Nick string
+    Callback string
+}
+
+type RecvArgs struct {
+    Nick string
+    Text string
+}
+
+/*The ChatClient interface from chat.idl, the server calls it for every
+* message instead of us polling for them.*/
+type ChatClient int
+
+func (c *ChatClient) Recieve(args *RecvArgs, _ *struct{}) error {
+    if args.Nick == SNAME {
+	fmt.Print(args.Text)
+    } else {
+	fmt.Printf("[%s] - %s: %s", time.Now().Format(time.Kitchen), args.Nick, args.Text)
+    }
+    return nil
+}
+
 var Token string
 var client *rpc.Client
 var waitG sync.WaitGroup
@@ -57,6 +90,10 @@ func UserIn() {
       }
       
       usrParse(usrStr)
+      if strings.HasPrefix(usrStr, COMM_QUITCHAT) {
+	/*Quitting already let main finish.*/
+	break
+      }
       
   }
   
@@ -81,6 +118,9 @@ func usrParse(usrStr string) (err error) {
 	case strings.HasPrefix(usrStr, COMM_CHANGENAME):
 		cName := strings.TrimSuffix(strings.TrimPrefix(usrStr, COMM_CHANGENAME+" "), "\n")
 		err = client.Call("Receiver.ChangeName", Args{Token, cName}, nil)
+		if err != nil && err.Error() == ERR_NAMEUSED {
+			fmt.Printf(MESS_NAMEUSED, cName)
+		}
 	case strings.HasPrefix(usrStr, COMM_QUITCHAT):
 		err = client.Call("Receiver.Quit", &Token, nil)
 		waitG.Done()
@@ -89,21 +129,6 @@ func usrParse(usrStr string) (err error) {
 	return err
 }
 
-func userOut() {
-    for {
-	var msg string
-	err := client.Call("Receiver.RecMsg", &Token, &msg)
-	//err := client.Call("Receiver.RecMsg", &Token, &msg)
-	if err != nil {
-	    fmt.Print(err)
-	    waitG.Done()
-	    break
-	}
-	fmt.Print(msg)
-    }
-    
-}
-
 func main() {
     waitG.Add(1)
     
@@ -112,12 +137,28 @@ func main() {
     if err != nil {
 	panic(err)
     }
-    err = client.Call("Receiver.Connect", &struct{}{}, &Token)
+    /*Serve ChatClient so the server can call us back.*/
+    nick := CNAME
+    if len(os.Args) > 1 {
+	nick = os.Args[1]
+    }
+    callbacks := rpc.NewServer()
+    callbacks.Register(new(ChatClient))
+    listen, err := net.Listen(TYPE, HOST+":0")
+    if err != nil {
+	log.Fatal(err)
+    }
+    go callbacks.Accept(listen)
+
+    err = client.Call("Receiver.Join", JoinArgs{nick, listen.Addr().String()}, &Token)
     if err != nil {
+     if err.Error() == ERR_NAMEUSED {
+	fmt.Printf(MESS_NAMEUSED, nick)
+	os.Exit(1)
+     }
      log.Fatal(err) 
     }
     go UserIn()
-    go userOut()
     
     waitG.Wait()
     fmt.Print(MESS_DISC)
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -15,10 +14,10 @@ import (
 type CRoom struct {
 	cName      string
 	curClients []*Client
-	msgs       []string
+	msgs       []*Msg
 	join       chan *Client
 	leave      chan *Client
-	incoming   chan string
+	incoming   chan *Msg
 	expiry     chan bool
 	expire     time.Time
 }
@@ -31,10 +30,10 @@ func NewCRoom(cName string) *CRoom {
 	cRoom := &CRoom{
 		cName:      cName,
 		curClients: make([]*Client, 0),
-		msgs:       make([]string, 0),
+		msgs:       make([]*Msg, 0),
 		join:	    make(chan *Client),
 		leave:      make(chan *Client),
-		incoming:   make(chan string),
+		incoming:   make(chan *Msg),
 		expiry:     make(chan bool),
 		expire:     time.Now().Add(EXTIME),
 	}
@@ -68,7 +67,7 @@ func (cRoom *CRoom) Delete() {
       cRoom.expiry <- true
     }()
   } else {
-    cRoom.Broadcast(NOTE_ROOM_DELETION)
+    cRoom.Broadcast(NewNote(NOTE_ROOM_DELETION))
     for _, client := range cRoom.curClients {
       client.Mutex.Lock()
       client.CRoom = nil
@@ -83,9 +82,9 @@ func (cRoom *CRoom) AddClient(client *Client) {
   client.Mutex.Lock()
   defer client.Mutex.Unlock()
   
-  cRoom.Broadcast(fmt.Sprintf(NOTE_ROOM_ENTER, client.Name))
+  cRoom.Broadcast(NewNote(fmt.Sprintf(NOTE_ROOM_ENTER, client.Name)))
   for _, msg := range cRoom.msgs {
-    client.outMsg <- msg
+    client.Deliver(msg)
   }
   cRoom.curClients = append(cRoom.curClients, client)
   client.CRoom = cRoom
@@ -94,7 +93,7 @@ func (cRoom *CRoom) AddClient(client *Client) {
 
 func (cRoom *CRoom) removeClient(client *Client) {
   client.Mutex.RLock()
-  cRoom.Broadcast(fmt.Sprintf(NOTE_ROOM_LEAVE, client.Name))
+  cRoom.Broadcast(NewNote(fmt.Sprintf(NOTE_ROOM_LEAVE, client.Name)))
   client.Mutex.RUnlock()
   for i, oClients := range cRoom.curClients {
     if client == oClients {
@@ -108,12 +107,12 @@ func (cRoom *CRoom) removeClient(client *Client) {
   log.Println("Removed client\n")
 }
 
-func (cRoom *CRoom) Broadcast(msg string) {
+func (cRoom *CRoom) Broadcast(msg *Msg) {
   cRoom.expire = time.Now().Add(EXTIME)
-  log.Println(msg)
+  log.Println(msg.String())
   cRoom.msgs = append(cRoom.msgs, msg)
   for _, client := range cRoom.curClients {
-    client.outMsg <- msg
+    client.Deliver(msg)
   }
 }
 
@@ -123,7 +122,7 @@ func addCRoom (cRoom *CRoom) error {
   
   oCRoom := cRooms[cRoom.cName]
   if oCRoom != nil {
-    return errors.New(ERR_CREATE)
+    return ErrRoomAlreadyExists
   }
   cRooms[cRoom.cName] = cRoom
   return nil
@@ -135,7 +134,7 @@ func deleteCRoom (cName string) error {
   
   cRoom := cRooms[cName]
   if cRoom == nil {
-    return errors.New(ERR_ENTER)
+    return ErrRoomDoesNotExist
   }
   delete(cRooms, cName)
   return nil
@@ -147,7 +146,7 @@ func getCRoom (cName string) (*CRoom, error) {
     
     cRoom := cRooms[cName]
     if cRoom == nil {
-      return nil, errors.New(ERR_ENTER)
+      return nil, ErrRoomDoesNotExist
     }
     return cRoom, nil
 }
@@ -2,27 +2,83 @@ package main
 
 import (
   "errors"
+  "fmt"
+  "log"
+  "net/rpc"
+  "strconv"
   "sync"
+  "time"
 )
 
 var curClients map[string]*Client = make(map[string]*Client)
 var curClientsMutex sync.RWMutex
+/*The last number handed out for a guest name, guarded by curClientsMutex.*/
+var guests int
 
 type Client struct {
   Token string
   Name string
   CRoom *CRoom
-  outMsg chan string
+  quit chan bool
   Mutex sync.RWMutex
+
+  /*Mailbox of the latest messages, numbered per client so a reconnecting
+  * client can ask for everything after the last id it saw.*/
+  msgs []*Msg
+  lastId uint64
+  recCursor uint64
+  arrived chan bool
+  boxMutex sync.Mutex
+}
+
+/*Everything delivered to a client, who said it (SNAME for server notes) and
+* what they said. RecMsg hands out the String() of it, the ChatClient
+* callback gets the nick and text separately.*/
+type Msg struct {
+  Id uint64
+  Time time.Time
+  Nick string
+  Text string
 }
 
 func NewClient(tok string) *Client {
   return &Client{
     Token: tok,
-    Name: "Anon",
+    Name: CNAME,
     CRoom: nil,
-    outMsg: make(chan string),
+    quit: make(chan bool),
+    msgs: make([]*Msg, 0),
+    arrived: make(chan bool),
+  }
+}
+
+/*A note from the server rather than another user.*/
+func NewNote(text string) *Msg {
+  return &Msg{Time: time.Now(), Nick: SNAME, Text: text}
+}
+
+func (msg *Msg) String() string {
+  if msg.Nick == SNAME {
+    return msg.Text
+  }
+  return fmt.Sprintf("[%s] - %s: %s", msg.Time.Format(time.Kitchen), msg.Nick, msg.Text)
+}
+
+/*Every name has to be unique, clients that joined without one are given a
+* numbered guest name instead.*/
+func nameInUse(name string, self *Client) bool {
+  for _, oClient := range curClients {
+    if oClient == self {
+      continue
+    }
+    oClient.Mutex.RLock()
+    oName := oClient.Name
+    oClient.Mutex.RUnlock()
+    if oName == name {
+      return true
+    }
   }
+  return false
 }
 
 func AddClient(client *Client) error {
@@ -33,19 +89,52 @@ func AddClient(client *Client) error {
   if oClient != nil {
     return errors.New(ERR_TOK)
   }
+  if client.Name == CNAME {
+    client.Name = guestName()
+  }
+  if nameInUse(client.Name, client) {
+    return ErrNameAlreadyUsed
+  }
   curClients[client.Token] = client
   return nil
 }
 
+/*The next free guest name, Anon1, Anon2 and so on. Call with curClientsMutex
+* held.*/
+func guestName() string {
+  for {
+    guests++
+    name := CNAME + strconv.Itoa(guests)
+    if !nameInUse(name, nil) {
+      return name
+    }
+  }
+}
+
+/*Change a clients name, as long as nobody else is using it.*/
+func RenameClient(client *Client, name string) error {
+  curClientsMutex.Lock()
+  defer curClientsMutex.Unlock()
+
+  if nameInUse(name, client) {
+    return ErrNameAlreadyUsed
+  }
+  client.Mutex.Lock()
+  defer client.Mutex.Unlock()
+  client.Name = name
+  return nil
+}
+
 func RemoveClient (tok string) error {
   curClientsMutex.Lock()
   defer curClientsMutex.Unlock()
   
   client := curClients[tok]
   if client == nil {
-    return errors.New(ERR_TOK)
+    return ErrUnknownID
   }
   delete(curClients, tok)
+  close(client.quit)
   return nil
 }
 
@@ -55,7 +144,115 @@ func GetClient(tok string) (*Client, error){
   
   client := curClients[tok]
   if client == nil {
-    return nil, errors.New(ERR_TOK)
+    return nil, ErrUnknownID
   }
   return client, nil
-}
\ No newline at end of file
+}
+
+/*Put a message in the clients mailbox and wake up anyone waiting on it. The
+* same Msg is broadcast to a whole room, so each client numbers its own copy.
+* Never blocks, once the mailbox is full the oldest messages are dropped.*/
+func (client *Client) Deliver(msg *Msg) {
+  client.boxMutex.Lock()
+  defer client.boxMutex.Unlock()
+
+  own := *msg
+  client.lastId++
+  own.Id = client.lastId
+  client.msgs = append(client.msgs, &own)
+  if len(client.msgs) > MAILBOX_MAX {
+    client.msgs = client.msgs[len(client.msgs)-MAILBOX_MAX:]
+  }
+  close(client.arrived)
+  client.arrived = make(chan bool)
+}
+
+/*Every message with an id after the cursor, waiting up to wait for one to
+* arrive if there are none yet. missed is true if some were already dropped
+* from the mailbox, so the client knows there is a gap.*/
+func (client *Client) MsgsSince(cursor uint64, wait time.Duration) (msgs []*Msg, missed bool) {
+  timeout := time.After(wait)
+  for {
+    client.boxMutex.Lock()
+    arrived := client.arrived
+    msgs = make([]*Msg, 0)
+    for _, msg := range client.msgs {
+      if msg.Id > cursor {
+        msgs = append(msgs, msg)
+      }
+    }
+    missed = len(client.msgs) > 0 && client.msgs[0].Id > cursor+1
+    client.boxMutex.Unlock()
+
+    if len(msgs) > 0 {
+      return msgs, missed
+    }
+    select {
+    case <-arrived:
+    case <-timeout:
+      return msgs, missed
+    case <-client.quit:
+      return msgs, missed
+    }
+  }
+}
+
+/*The next message for RecMsg, which keeps its own cursor. Blocks until
+* there is one or the client quits.*/
+func (client *Client) NextMsg() (*Msg, error) {
+  for {
+    client.boxMutex.Lock()
+    cursor := client.recCursor
+    client.boxMutex.Unlock()
+
+    msgs, _ := client.MsgsSince(cursor, time.Hour)
+    select {
+    case <-client.quit:
+      return nil, ErrUnknownID
+    default:
+    }
+    if len(msgs) == 0 {
+      continue
+    }
+    client.boxMutex.Lock()
+    client.recCursor = msgs[0].Id
+    client.boxMutex.Unlock()
+    return msgs[0], nil
+  }
+}
+
+/*Push everything in the clients mailbox to its ChatClient.recieve callback,
+* so it doesn't have to keep polling RecMsg. If the callback goes away the
+* client is dropped.*/
+func (client *Client) CallBack(callback *rpc.Client) {
+  defer callback.Close()
+  var cursor uint64
+  for {
+    msgs, _ := client.MsgsSince(cursor, time.Hour)
+    select {
+    case <-client.quit:
+      return
+    default:
+    }
+    for _, msg := range msgs {
+      err := callback.Call("ChatClient.Recieve", &RecvArgs{Nick: msg.Nick, Text: msg.Text}, nil)
+      if err != nil {
+        log.Println("Callback failed, dropping client: ", err)
+        client.Leave()
+        return
+      }
+      cursor = msg.Id
+    }
+  }
+}
+
+/*Take the client out of its room and forget about it.*/
+func (client *Client) Leave() error {
+  client.Mutex.RLock()
+  cRoom := client.CRoom
+  client.Mutex.RUnlock()
+  if cRoom != nil {
+    cRoom.leave <- client
+  }
+  return RemoveClient(client.Token)
+}
@@ -0,0 +1,17 @@
+package main
+
+/*The exceptions chat.idl declares. net/rpc only carries the text of an error
+* across the wire, so the text is the IDL name and clients tell them apart by
+* comparing err.Error() against these.*/
+type ChatError string
+
+func (err ChatError) Error() string {
+  return string(err)
+}
+
+const (
+  ErrNameAlreadyUsed   ChatError = "NameAlreadyUsed"
+  ErrUnknownID         ChatError = "UnknownID"
+  ErrRoomDoesNotExist  ChatError = "roomDoesNotExist"
+  ErrRoomAlreadyExists ChatError = "roomAlreadyExists"
+)
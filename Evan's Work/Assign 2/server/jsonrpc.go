@@ -0,0 +1,51 @@
+package main
+
+import (
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "net/rpc"
+  "net/rpc/jsonrpc"
+)
+
+/*Lets non Go clients drive the Receiver. The same methods are served with the
+* JSON-RPC 1.0 codec, either over a raw TCP connection on JSONRPC_PORT or one
+* request per HTTP POST to JSONRPC_PATH, e.g.
+*   {"method": "Receiver.Connect", "params": [{}], "id": 1}*/
+
+/*The body of a POST and its response, glued together so the codec can treat
+* them as a connection.*/
+type httpConn struct {
+  in  io.Reader
+  out io.Writer
+}
+
+func (conn *httpConn) Read(p []byte) (int, error)  { return conn.in.Read(p) }
+func (conn *httpConn) Write(p []byte) (int, error) { return conn.out.Write(p) }
+func (conn *httpConn) Close() error                { return nil }
+
+/*Accept raw TCP JSON-RPC connections, each one gets its own codec.*/
+func serveJSONRPC(listen net.Listener) {
+  for {
+    conn, err := listen.Accept()
+    if err != nil {
+      log.Println("JSON-RPC accept error: ", err)
+      continue
+    }
+    go jsonrpc.ServeConn(conn)
+  }
+}
+
+/*Handle one JSON-RPC request per HTTP POST.*/
+func jsonRPCHandler(w http.ResponseWriter, req *http.Request) {
+  if req.Method != "POST" {
+    http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  err := rpc.ServeRequest(jsonrpc.NewServerCodec(&httpConn{in: req.Body, out: w}))
+  if err != nil {
+    log.Println("JSON-RPC request error: ", err)
+  }
+}
@@ -13,6 +13,9 @@ const (
 	TYPE = "tcp"
 	PORT = ":65535"
 	HOST = "localhost"
+	/*JSON-RPC is served on its own port, and over HTTP next to the gob handler.*/
+	JSONRPC_PORT = ":65534"
+	JSONRPC_PATH = "/jsonrpc"
 	/*Notices for the server to output whenever a user joins, etc.*/
 	NOTE_PREFIX         = "Note: "
 	NOTE_CHANGENAME     = NOTE_PREFIX + "Changed their name to [%s].\n"
@@ -30,7 +33,7 @@ const (
 	ERR_SEND   = ERR_PREFIX + "Cannot send messages in the lobby.\n"
 	ERR_TOK	   = ERR_PREFIX + "User not found with this token!\n"
 
-	/*Client name, followed by the server name.*/
+	/*Client name, guests get a number after it, followed by the server name.*/
 	CNAME = "Anon"
 	SNAME = "MyServer"
 
@@ -45,17 +48,28 @@ const (
 	/*An expiry time for messages, they have to be seven days old to be deleted.*/
 	EXTIME time.Duration = 7 * 24 * time.Hour
 
+	/*How many messages a client's mailbox keeps for RecMsgs, and the longest
+	* RecMsgs will wait for a new one.*/
+	MAILBOX_MAX = 256
+	MAXWAIT time.Duration = 60 * time.Second
+
 )
 
 func main() {
 	  receive := new(Receiver)
 	  rpc.Register(receive)
 	  rpc.HandleHTTP()
+	  http.HandleFunc(JSONRPC_PATH, jsonRPCHandler)
 	  listen, err := net.Listen(TYPE, PORT)
 	  if err != nil {
 		log.Fatal("Listen error: ", err)
 	  
 	  }
+	  jsonListen, err := net.Listen(TYPE, JSONRPC_PORT)
+	  if err != nil {
+		log.Fatal("JSON-RPC listen error: ", err)
+	  }
+	  go serveJSONRPC(jsonListen)
 	  log.Print("Starting server")
 	  http.Serve(listen, nil)
 
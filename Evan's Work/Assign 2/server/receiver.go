@@ -5,6 +5,7 @@ import (
   "encoding/base64"
   "fmt"
   "log"
+  "net/rpc"
   "time"
 )
 
@@ -13,6 +14,44 @@ type Args struct {
   String string
 }
 
+/*Arguments for Join, the nick to use and the address of the clients own RPC
+* server exporting ChatClient. Without a callback the client polls RecMsg.*/
+type JoinArgs struct {
+  Nick string
+  Callback string
+}
+
+/*Arguments for RecMsgs, the id of the last message the client has seen (0
+* for everything still in its mailbox) and how long to wait for new ones in
+* milliseconds.*/
+type RecArgs struct {
+  Token string
+  Cursor uint64
+  Wait int
+}
+
+/*Reply from RecMsgs, pass Cursor back on the next call. Missed is set when
+* messages after the cursor had already been dropped from the mailbox.*/
+type RecReply struct {
+  Msgs []Msg
+  Cursor uint64
+  Missed bool
+}
+
+/*Arguments for the ChatClient.Recieve callback, spelled as in chat.idl.*/
+type RecvArgs struct {
+  Nick string
+  Text string
+}
+
+/*Receiver implements the ChatServer interface from chat.idl:
+*   join   -> Join (or Connect for an anonymous, polling client)
+*   leave  -> Quit
+*   send   -> SendMsg
+*   create -> CreateCRoom
+*   enter  -> JoinCRoom
+*   list   -> ListCRooms
+* and raises the IDL exceptions as ChatErrors.*/
 type Receiver int
 
 func randString(len int) (str string) {
@@ -30,7 +69,40 @@ func (r *Receiver) Connect(args *struct{}, tok *string) error {
     log.Println(err)
     return err
   }
-  go func() {client.outMsg <- SCONNECT }()
+  client.Deliver(NewNote(SCONNECT))
+  return nil
+}
+
+/*join from chat.idl. The nick has to be unique, and if a callback address is
+* given every message is pushed to the clients ChatClient.Recieve.*/
+func (r *Receiver) Join(args *JoinArgs, tok *string) error {
+  log.Println("Joining as " + args.Nick)
+  client := NewClient(randString(64))
+  if args.Nick != "" {
+    client.Name = args.Nick
+  }
+  var callback *rpc.Client
+  if args.Callback != "" {
+    var err error
+    callback, err = rpc.Dial(TYPE, args.Callback)
+    if err != nil {
+      log.Println(err)
+      return err
+    }
+  }
+  err := AddClient(client)
+  if err != nil {
+    if callback != nil {
+      callback.Close()
+    }
+    log.Println(err)
+    return err
+  }
+  *tok = client.Token
+  if callback != nil {
+    go client.CallBack(callback)
+  }
+  client.Deliver(NewNote(SCONNECT))
   return nil
 }
 
@@ -40,11 +112,39 @@ func (r *Receiver) RecMsg(tok *string, msg *string) error {
   if err != nil {
     return err
   }
-  *msg = <-client.outMsg
+  next, err := client.NextMsg()
+  if err != nil {
+    return err
+  }
+  *msg = next.String()
   return nil
 
 }
 
+/*Batched version of RecMsg. Returns every message after the cursor, waiting
+* up to args.Wait (capped at MAXWAIT) for one if there are none. Nothing is
+* taken out of the mailbox, so a client that drops mid-call just asks again
+* with the same cursor.*/
+func (r *Receiver) RecMsgs(args *RecArgs, reply *RecReply) error {
+  client, err := GetClient(args.Token)
+  if err != nil {
+    return err
+  }
+  wait := time.Duration(args.Wait) * time.Millisecond
+  if wait < 0 || wait > MAXWAIT {
+    wait = MAXWAIT
+  }
+  msgs, missed := client.MsgsSince(args.Cursor, wait)
+  reply.Msgs = make([]Msg, len(msgs))
+  reply.Cursor = args.Cursor
+  for i, msg := range msgs {
+    reply.Msgs[i] = *msg
+    reply.Cursor = msg.Id
+  }
+  reply.Missed = missed
+  return nil
+}
+
 func (r *Receiver) SendMsg(args *Args, _ *struct{}) error {
   log.Println("Sending a message.\n")
   client, err := GetClient(args.Token)
@@ -55,20 +155,20 @@ func (r *Receiver) SendMsg(args *Args, _ *struct{}) error {
   client.Mutex.RLock()
   defer client.Mutex.RUnlock()
   if client.CRoom == nil {
-    client.outMsg <- ERR_SEND
+    client.Deliver(NewNote(ERR_SEND))
     return nil
   }
-  client.CRoom.incoming <- fmt.Sprintf("[%s] - %s: %s", time.Now().Format(time.Kitchen), client.Name, args.String)
+  client.CRoom.incoming <- &Msg{Time: time.Now(), Nick: client.Name, Text: args.String}
   return nil
 }
 
 func (r *Receiver) Quit(tok *string, _ *struct{}) error {
   log.Println("User quitting\n")
-  err := RemoveClient(*tok)
+  client, err := GetClient(*tok)
   if err != nil {
     return err
   }
-  return nil
+  return client.Leave()
 }
 
 /*Functions for the chat rooms for reciever.*/
@@ -82,11 +182,11 @@ func (r *Receiver) CreateCRoom(args *Args, _ *struct{}) error {
   cRoom := NewCRoom(args.String)
   err = addCRoom(cRoom)
   if err != nil {
-    client.outMsg <- err.Error()
+    client.Deliver(NewNote(ERR_CREATE))
     log.Println(err)
     return err
   }
-  client.outMsg <- fmt.Sprintf(NOTE_ROOM_CREATE, cRoom.cName)
+  client.Deliver(NewNote(fmt.Sprintf(NOTE_ROOM_CREATE, cRoom.cName)))
   return nil
 }
 
@@ -99,7 +199,7 @@ func (r *Receiver) JoinCRoom (args *Args, _ *struct{}) error {
   }
   cRoom, err := getCRoom(args.String)
   if err != nil {
-    client.outMsg <- err.Error()
+    client.Deliver(NewNote(ERR_ENTER))
     log.Println(err)
     return err
   }
@@ -125,6 +225,10 @@ func (r *Receiver) LeaveCRoom(tok *string, _ *struct{}) error {
   client.Mutex.RLock()
   defer client.Mutex.RUnlock()
   
+  if client.CRoom == nil {
+    client.Deliver(NewNote(ERR_LEAVE))
+    return nil
+  }
   client.CRoom.leave <- client
   return nil
 }
@@ -142,7 +246,7 @@ func (r *Receiver) ListCRooms(tok *string, _ *struct{}) error {
     cList += cRoomName + "\n"
   }
   cList += "\n"
-  client.outMsg <- cList
+  client.Deliver(NewNote(cList))
   return nil
 }
 
@@ -153,8 +257,5 @@ func (r *Receiver) ChangeName(args *Args, _ *struct{}) error {
     log.Println("Error changing null client name.\n")
     return err
   }
-  client.Mutex.Lock()
-  defer client.Mutex.Unlock()
-  client.Name = args.String
-  return nil
+  return RenameClient(client, args.String)
 }
\ No newline at end of file
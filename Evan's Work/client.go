@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
 	"regexp"
 	"strings"
 )
@@ -29,16 +30,16 @@ type Command struct {
 
 // Main portion of program now. Will just watch for chat server and user input commands.
 func main() {
-	username, props := getConfig()
+	username, password, props := getConfig()
 
 	// Connect to the server.
-	connect, errNum := net.Dial("tcp", props.Host+":"+props.Port)
+	connect, errNum := util.Dial("tcp", props.Host+":"+props.Port, props.TLS)
 	// Error check.
 	util.CheckForError(errNum, "Connection Refused")
 	defer connect.Close()
 
 	// Listen for both commands.
-	go watchForServerIn(username, props, connect)
+	go watchForServerIn(username, password, props, connect)
 	for true {
 		watchForConsoleIn(connect)
 	}
@@ -78,13 +79,19 @@ func watchForConsoleIn(connect net.Conn) {
 					sendCommandToServ("disconnect", "", connect)
 				// If user leaves a room.
 				case "leave":
-					sendCommandToServ("leave", "", connect)
+					sendCommandToServ("leave", command.Body, connect)
+				// If user switches which of their rooms they talk in.
+				case "switch", "w":
+					sendCommandToServ("switch", command.Body, connect)
 				// If user enters room.
 				case "enter":
 					sendCommandToServ("enter", command.Body, connect)
 				// If user wants to list rooms.
 				case "list":
 					sendCommandToServ("list", "", connect)
+				// If user registers a name, or logs in with one.
+				case "register", "login":
+					sendCommandToServ(command.Cmd, command.Body, connect)
 				// Default case is unknown commands.
 				default:
 					fmt.Printf("Unknown command: \"%s\"\n", command.Cmd)
@@ -102,7 +109,7 @@ func watchForConsoleIn(connect net.Conn) {
 // This function is much like the previous one, but relies a lot more
 // on the server rather than the client.
 
-func watchForServerIn(user string, props util.Properties, connect net.Conn) {
+func watchForServerIn(user string, password string, props util.Properties, connect net.Conn) {
 	readIn := bufio.NewReader(connect)
 
 	for true {
@@ -123,7 +130,23 @@ func watchForServerIn(user string, props util.Properties, connect net.Conn) {
 				}
 			// Initial we are ready, sends out username to server.
 			case "ready":
-				sendCommandToServ("user", user, connect)
+				sendCommandToServ("user", strings.TrimSpace(user+" "+password), connect)
+
+			// Registered names need the right password.
+			case "reserved":
+				fmt.Printf("[%s] is registered, give its password after the name, or /login name password\n", Cmd.User)
+			case "nametaken":
+				fmt.Printf("Someone is already using [%s], reconnect with another name\n", Cmd.User)
+			case "registered":
+				fmt.Printf("Registered [%s], only you can use it now\n", Cmd.User)
+			case "registerfailed":
+				fmt.Printf("Could not register [%s]: %s\n", Cmd.User, Cmd.Body)
+			case "loggedin":
+				fmt.Printf("Logged in as [%s]\n", Cmd.User)
+			case "loginfailed":
+				fmt.Printf("Wrong name or password for [%s]\n", Cmd.User)
+			case "loginwait":
+				fmt.Printf("Too many wrong passwords, try [%s] again in %s\n", Cmd.User, Cmd.Body)
 
 			// Handle connect and disconnect calls.
 			case "connect":
@@ -143,11 +166,44 @@ func watchForServerIn(user string, props util.Properties, connect net.Conn) {
 			case "leave":
 				fmt.Printf(props.HasLeftRoomMsg+"\n", Cmd.User, Cmd.Body)
 
+			// Which room messages go to now, or a room or command the server didn't know.
+			case "switch":
+				fmt.Printf("Now talking in \"%s\"\n", Cmd.Body)
+			case "unrecognized":
+				fmt.Printf("The server didn't recognize \"%s\"\n", Cmd.Body)
+
 			}
 		}
 	}
 }
 
+// Ask for a password on the console without showing it as it's typed. It's
+// read a byte at a time so none of the chat input after it gets buffered here.
+func readPassword(prompt string) string {
+	fmt.Print(prompt)
+	stty("-echo")
+	defer stty("echo")
+
+	password := []byte{}
+	oneByte := make([]byte, 1)
+	for {
+		n, errNo := os.Stdin.Read(oneByte)
+		if errNo != nil || (n == 1 && oneByte[0] == '\n') {
+			break
+		}
+		password = append(password, oneByte[:n]...)
+	}
+	fmt.Println()
+	return strings.TrimSpace(string(password))
+}
+
+// Turn console echo on or off. Nothing happens if stdin isn't a terminal.
+func stty(setting string) {
+	cmd := exec.Command("stty", setting)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
 // Send a command to the chat server, we just simply write the message to the net connection.
 // Just send it as a byte array(?)
 func sendCommandToServ(cmd string, body string, connect net.Conn) {
@@ -189,10 +245,12 @@ func parseCommand(msg string) Command {
 	}
 }
 
-// Grab the contents of the config file.
-func getConfig() (string, util.Properties) {
+// Grab the contents of the config file. The password for a registered name
+// is asked for rather than given as an argument, where anyone could see it.
+func getConfig() (string, string, util.Properties) {
 	if len(os.Args) >= 2 {
 		user := os.Args[1]
+		password := readPassword(fmt.Sprintf("Password for [%s], or just enter for none: ", user))
 		props := util.Properties{
 			Host:               "localhost",
 			Port:               "5555",
@@ -202,11 +260,12 @@ func getConfig() (string, util.Properties) {
 			HasLeftLobbyMsg:    "[%s] has left the lobby",
 			ReceivedMsg:        "[%s] says: %s",
 			LogFile:            "",
+			TLS:                util.LoadTLSConfig(),
 		}
-		return user, props
+		return user, password, props
 	} else {
 		println("You must provide your username as the first argument!")
 		os.Exit(1)
-		return "", util.Properties{}
+		return "", "", util.Properties{}
 	}
 }
@@ -0,0 +1,186 @@
+// Live room feed over HTTP, for clients that can't reach the raw TCP port.
+//
+// > GET  /rooms/events/{room}            Server-Sent Events, resumes from Last-Event-ID
+// > GET  /rooms/poll/{room}?cursor={n}   long poll, returns {"Cursor": n, "Actions": [...]}
+// > POST /rooms/send/{room}              form values "user", "message", and "password" for registered names
+//
+// Served over TLS when the "TLS" section of config.json turns it on, like the
+// chat port. Without it registered names can't post, their passwords would
+// cross the network in the clear.
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"../../util"
+)
+
+const EVENTS_PATH = "/rooms/events/"
+const POLL_PATH = "/rooms/poll/"
+const SEND_PATH = "/rooms/send/"
+
+// How long a long poll waits for something to happen before returning empty.
+const POLL_TIMEOUT = 30 * time.Second
+
+// How often an idle event stream sends a comment so proxies keep it open.
+const KEEPALIVE_TIME = 15 * time.Second
+
+// Reply to a long poll, the cursor is passed back on the next request.
+type PollResult struct {
+	Cursor  int
+	Actions []util.Action
+}
+
+// Registered names, posting as one takes its password.
+var users *util.UserStore
+
+func Start(userStore *util.UserStore) {
+	properties := util.LoadConfig()
+	users = userStore
+
+	http.HandleFunc(EVENTS_PATH, roomEvents)
+	http.HandleFunc(POLL_PATH, roomPoll)
+	http.HandleFunc(SEND_PATH, roomSend)
+
+	listener, err := util.Listen("tcp", ":"+properties.StreamEndpointPort, properties.TLS)
+	util.CheckForError(err, "Can't create stream endpoint")
+	err = http.Serve(listener, nil)
+	util.CheckForError(err, "Can't serve stream endpoint")
+}
+
+// Stream a room as Server-Sent Events. Each event id is the cursor after that
+// action, so a browser reconnecting with Last-Event-ID picks up where it left.
+func roomEvents(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Path[len(EVENTS_PATH):]
+	flusher, ok := w.(http.Flusher)
+	if !ok || room == "" {
+		http.Error(w, "Streaming not supported", http.StatusBadRequest)
+		return
+	}
+
+	// New subscribers only get live messages unless they ask for a cursor.
+	cursor := -1
+	if lastId := r.Header.Get("Last-Event-ID"); lastId != "" {
+		cursor = parseCursor(lastId, -1)
+	} else {
+		cursor = parseCursor(r.URL.Query().Get("cursor"), -1)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		actions, next, changed := util.ActionsSince(room, cursor)
+		for _, action := range actions {
+			payload, err := json.Marshal(action)
+			util.CheckForError(err, "Can't create event")
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", action.Id+1, action.Comm, payload)
+		}
+		cursor = next
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-time.After(KEEPALIVE_TIME):
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Long poll fallback, answers straight away if there is anything past the
+// cursor, otherwise waits up to POLL_TIMEOUT for the room to say something.
+// Without a cursor the whole room history is returned.
+func roomPoll(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Path[len(POLL_PATH):]
+	if room == "" {
+		http.Error(w, "No room given", http.StatusBadRequest)
+		return
+	}
+	cursor := parseCursor(r.URL.Query().Get("cursor"), 0)
+	timeout := time.After(POLL_TIMEOUT)
+
+	for {
+		actions, next, changed := util.ActionsSince(room, cursor)
+		if len(actions) > 0 {
+			writePoll(w, next, actions)
+			return
+		}
+		cursor = next
+		select {
+		case <-changed:
+		case <-timeout:
+			writePoll(w, cursor, actions)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Post a message into a room from the HTTP side. Nobody can post as someone
+// connected over TCP, and registered names need their password, sent over
+// TLS, with the same backoff after wrong ones as the chat port.
+func roomSend(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Path[len(SEND_PATH):]
+	if r.Method != "POST" {
+		http.Error(w, "Messages must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := r.FormValue("user")
+	message := r.FormValue("message")
+	if room == "" || user == "" || message == "" {
+		http.Error(w, "A room, user and message are required", http.StatusBadRequest)
+		return
+	}
+
+	if util.FindUser(user) != nil {
+		http.Error(w, "Someone is connected with that name", http.StatusConflict)
+		return
+	}
+	if users.Registered(user) {
+		if r.TLS == nil {
+			http.Error(w, "That name is registered, its password can only be sent over TLS", http.StatusForbidden)
+			return
+		}
+		addr := util.HostOf(r.RemoteAddr)
+		if wait := users.Backoff(addr); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			http.Error(w, "Too many wrong passwords", http.StatusTooManyRequests)
+			return
+		}
+		if !users.Login(user, r.FormValue("password")) {
+			users.Failed(addr)
+			http.Error(w, "That name is registered, a password is required", http.StatusForbidden)
+			return
+		}
+		users.Succeeded(addr)
+	}
+
+	util.PostMessage(user, room, message, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePoll(w http.ResponseWriter, cursor int, actions []util.Action) {
+	payload, err := json.Marshal(PollResult{Cursor: cursor, Actions: actions})
+	util.CheckForError(err, "Can't create JSON response")
+
+	w.Header().Set("Content-Type", "text/json")
+	w.Write(payload)
+}
+
+// Cursors come from query strings and headers, fall back on anything odd.
+func parseCursor(val string, fallback int) int {
+	cursor, err := strconv.Atoi(val)
+	if err != nil {
+		return fallback
+	}
+	return cursor
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"./util"
 	"bufio"
 	"fmt"
 	"net"
@@ -80,9 +81,10 @@ func main() {
 	* or a semaphore*/
 	wGroup.Add(1)
 
-	connect, errNo := net.Dial(TYPE, HOST+PORT)
+	connect, errNo := util.Dial(TYPE, HOST+PORT, util.LoadTLSConfig())
 	if errNo != nil {
 		fmt.Println(errNo)
+		os.Exit(1)
 	}
 	/*Start both the handle for server and write ins.*/
 	go HandleServerIn(connect)
@@ -3,11 +3,19 @@
 package main
 
 import (
+	"./util"
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,8 +33,16 @@ const (
 	COMM_ENTERROOM  = COMM_PREFIX + "enter"
 	COMM_LEAVEROOM  = COMM_PREFIX + "leave"
 	COMM_LISTROOMS  = COMM_PREFIX + "list"
+	COMM_SWITCHROOM = COMM_PREFIX + "switch"
+	COMM_SHORTSWITCH = COMM_PREFIX + "w"
+	COMM_ARCHIVES    = COMM_PREFIX + "archives"
+	COMM_RESTORE     = COMM_PREFIX + "restore"
+	COMM_HISTORY     = COMM_PREFIX + "history"
 
 	COMM_CHANGENAME = COMM_PREFIX + "name"
+	COMM_REGISTER   = COMM_PREFIX + "register"
+	COMM_LOGIN      = COMM_PREFIX + "login"
+	COMM_RESUME     = COMM_PREFIX + "resume"
 	COMM_QUITCHAT   = COMM_PREFIX + "quit"
 	COMM_HELPCHAT   = COMM_PREFIX + "help"
 
@@ -37,7 +53,17 @@ const (
 	NOTE_ROOM_ENTER     = NOTE_PREFIX + "[%s] has joined the room.\n"
 	NOTE_ROOM_LEAVE     = NOTE_PREFIX + "[%s] has left the room.\n"
 	NOTE_PUB_CHANGENAME = NOTE_PREFIX + "[%s] changed their name to [%s].\n"
-	NOTE_ROOM_DELETION  = NOTE_PREFIX + "Chat room is being deleted due to inactivity.\n"
+	NOTE_ROOM_DELETION  = NOTE_PREFIX + "Chat room is being archived due to inactivity, \"!restore %s\" brings it back.\n"
+	NOTE_ROOM_WARN      = NOTE_PREFIX + "Chat room will be archived in %s unless someone talks.\n"
+	NOTE_ROOM_RESTORE   = NOTE_PREFIX + "Restored the room {%s} with its history.\n"
+	NOTE_ROOM_SWITCH    = NOTE_PREFIX + "Now talking in {%s}.\n"
+	NOTE_REGISTERED     = NOTE_PREFIX + "Registered [%s], use \"!login %s password\" next time.\n"
+	NOTE_LOGIN          = NOTE_PREFIX + "Logged in as [%s].\n"
+	NOTE_BUMPED         = NOTE_PREFIX + "[%s] logged in with their registered name.\n"
+	NOTE_TOKEN          = NOTE_PREFIX + "If you lose your connection, reconnect within %s and use \"!resume %s\" to carry on.\n"
+	NOTE_RESUMED        = NOTE_PREFIX + "Welcome back [%s].\n"
+	NOTE_ROOM_BACK      = NOTE_PREFIX + "[%s] is back.\n"
+	NOTE_HISTORY_END    = NOTE_PREFIX + "No earlier messages in {%s}.\n"
 
 	/*List of error commands that a user can encounter.*/
 	ERR_PREFIX = "Error: "
@@ -45,8 +71,22 @@ const (
 	ERR_ENTER  = ERR_PREFIX + "Chat room does not exist, you cannot join.\n"
 	ERR_LEAVE  = ERR_PREFIX + "You cannot leave the lobby!\n"
 	ERR_SEND   = ERR_PREFIX + "Cannot send messages in the lobby.\n"
+	ERR_NOTIN  = ERR_PREFIX + "You are not in the room {%s}.\n"
+	ERR_RESERVED = ERR_PREFIX + "[%s] is registered, use \"!login %s password\" if it is yours.\n"
+	ERR_TAKEN    = ERR_PREFIX + "Someone else is using the name [%s].\n"
+	ERR_CERTNAME = ERR_PREFIX + "The name on your certificate [%s] is registered or in use, you are a guest instead.\n"
+	ERR_REGISTER = ERR_PREFIX + "Could not register, %s. Use \"!register name password\".\n"
+	ERR_LOGIN    = ERR_PREFIX + "Wrong name or password.\n"
+	ERR_LOGINBUSY = ERR_PREFIX + "Still checking your last password, wait for the answer.\n"
+	ERR_LOGINWAIT = ERR_PREFIX + "Too many wrong passwords, try again in %s.\n"
+	ERR_ARCHIVED = ERR_PREFIX + "That chat room is archived, try \"!restore %s\".\n"
+	ERR_RESTORE  = ERR_PREFIX + "There is no archived chat room with that name.\n"
+	ERR_PATTERN  = ERR_PREFIX + "{%s} is not a valid pattern, try something like dev-*.\n"
+	ERR_RESUME   = ERR_PREFIX + "That resume token is unknown or has expired.\n"
+	ERR_HISTORY  = ERR_PREFIX + "Use \"!history [n]\" in a chat room.\n"
 
-	/*Client name, followed by the server name.*/
+	/*Client name, guests get a number after it so nobody shares a name,
+	* followed by the server name.*/
 	CNAME = "Anon"
 	SNAME = "MyServer"
 
@@ -60,8 +100,57 @@ const (
 
 	/*An expiry time for messages, they have to be seven days old to be deleted.*/
 	EXTIME time.Duration = 7 * 24 * time.Hour
+	/*How long before a room is archived the users in it are warned.*/
+	WARNTIME time.Duration = time.Hour
+	/*How long a dropped user's name and rooms are held for them, and how many
+	* random bytes are in the token that gets them back.*/
+	RESUMETIME time.Duration = 5 * time.Minute
+	TOKENSIZE                = 32
+	/*Archived rooms are dropped for good after a while, or sooner, oldest
+	* first, once there are more than ARCHMAX of them.*/
+	ARCHTIME time.Duration = 30 * 24 * time.Hour
+	ARCHMAX                = 100
+
+	/*How !list can sort the rooms, and how it shows when one was last used.*/
+	LIST_NAME   = "name"
+	LIST_ACTIVE = "active"
+	LIST_SIZE   = "size"
+	LIST_TIME   = "Jan 2 15:04"
+
+	/*How much history a room keeps, by number of messages and by bytes, and
+	* how many of the newest messages are shown when a user joins or pages
+	* back with !history. The "History" section of config.json can change them.*/
+	MSGMAX      = 1000
+	MSGBYTESMAX = 256 * 1024
+	LOGREPLAY   = 20
+	CONFIGFILE  = "config.json"
 )
 
+/*How much history rooms keep and replay, 0 keeps everything.*/
+type HistoryConfig struct {
+	MaxMessages int
+	MaxBytes    int
+	Replay      int
+}
+
+/*Read the "History" section of config.json, anything it leaves out keeps
+* its default.*/
+func LoadHistoryConfig() *HistoryConfig {
+	var confData struct {
+		History HistoryConfig
+	}
+	confData.History = HistoryConfig{MaxMessages: MSGMAX, MaxBytes: MSGBYTESMAX, Replay: LOGREPLAY}
+	confFile, errNo := ioutil.ReadFile(CONFIGFILE)
+	if errNo != nil {
+		return &confData.History
+	}
+	if errNo = json.Unmarshal(confFile, &confData); errNo != nil {
+		log.Println("Error: ", errNo)
+		os.Exit(1)
+	}
+	return &confData.History
+}
+
 /*Begin with client features, such as adding a new client for a reader writer
 *and quitting.*/
 type Client struct {
@@ -71,7 +160,20 @@ type Client struct {
 	incMsg     chan *Msg
 	outMsg     chan string
 	cRoom      *CRoom
+	cRooms     []*CRoom
 	username   string
+	/*The registered name they logged in as, empty for guests.*/
+	account string
+	/*Hands their name and rooms to a new connection if this one drops,
+	* unless they left with !quit.*/
+	token    string
+	quitting bool
+	/*For each room, how many messages in the oldest one they have been
+	* shown is, which is where !history carries on from.*/
+	before map[*CRoom]int
+	/*Set while a !login or !register is being checked, they only get one
+	* at a time.*/
+	hashing bool
 }
 
 /*Create a constructor for a client, which will set the client to a deafult name
@@ -88,6 +190,7 @@ func ClientConstruct(connect net.Conn) *Client {
 		outMsg:     make(chan string),
 		cRoom:      nil,
 		username:   CNAME,
+		before:     make(map[*CRoom]int),
 	}
 	newClient.Listen()
 	return newClient
@@ -123,6 +226,38 @@ func (client *Client) WriteMsg() {
 	log.Println("Write thread is now closed for client.")
 }
 
+/*Find one of the rooms the client is in by name, nil if they aren't in it.*/
+func (client *Client) FindCRoom(cRoomName string) *CRoom {
+	for _, cRoom := range client.cRooms {
+		if cRoom.cName == cRoomName {
+			return cRoom
+		}
+	}
+	return nil
+}
+
+/*Take a room off the client's list. If they were talking in it, they go
+* back to the last room they joined, or the lobby if there are none left.*/
+func (client *Client) Forget(cRoom *CRoom) {
+	for k, oRoom := range client.cRooms {
+		if oRoom == cRoom {
+			client.cRooms = append(client.cRooms[:k], client.cRooms[k+1:]...)
+			break
+		}
+	}
+	if client.cRoom == cRoom {
+		client.cRoom = nil
+		if len(client.cRooms) > 0 {
+			client.cRoom = client.cRooms[len(client.cRooms)-1]
+		}
+	}
+}
+
+/*The address the client connected from, without the port.*/
+func (client *Client) Host() string {
+	return util.HostOf(client.connect.RemoteAddr().String())
+}
+
 /*Close the client connection if they wish to quit.*/
 func (client *Client) Quit() {
 	client.connect.Close()
@@ -150,20 +285,63 @@ type Lobby struct {
 	curClients []*Client
 	cRoom      map[string]*CRoom
 	incMsg     chan *Msg
-	delRoom    chan *CRoom
 	joinRoom   chan *Client
 	leaveRoom  chan *Client
+	/*Room expiry runs off one scheduler on the lobby thread, rather than
+	* a sleeping thread for every room.*/
+	scheduler *util.Scheduler
+	/*Expired rooms are kept here with their history, so they can be restored.*/
+	archived map[string]*CRoom
+	/*Registered names. Passwords are hashed on their own threads, since that
+	* is slow, and the results come back over logins.*/
+	users  *util.UserStore
+	logins chan *Login
+	/*The last number handed out for a guest name.*/
+	guests int
+	/*Users whose connection dropped, by resume token.*/
+	sessions map[string]*Session
+	/*How much each room keeps and replays.*/
+	history *HistoryConfig
+}
+
+/*What a dropped user had, held for a while so they can reconnect and
+* !resume it. Nobody else can take the name in the meantime.*/
+type Session struct {
+	username string
+	account  string
+	cRooms   []*CRoom
+	cRoom    *CRoom
+	/*How many messages each room had sent when they went, anything after
+	* that is replayed.*/
+	seen        map[*CRoom]int
+	expireEntry *util.ScheduleEntry
+}
+
+/*A !register or !login on its way back to the lobby thread once the
+* password has been checked.*/
+type Login struct {
+	client   *Client
+	name     string
+	register bool
+	errNo    error
+	ok       bool
 }
 
-/*Create a new lobby which listens over all channels.*/
-func NewLobby() *Lobby {
+/*Create a new lobby which listens over all channels. Rooms expire by the
+* given clock, and names can be registered in the user store.*/
+func NewLobby(clock util.Clock, users *util.UserStore, history *HistoryConfig) *Lobby {
 	newLob := &Lobby{
 		curClients: make([]*Client, 0),
 		cRoom:      make(map[string]*CRoom),
 		incMsg:     make(chan *Msg),
-		delRoom:    make(chan *CRoom),
 		joinRoom:   make(chan *Client),
 		leaveRoom:  make(chan *Client),
+		scheduler:  util.NewScheduler(clock),
+		archived:   make(map[string]*CRoom),
+		users:      users,
+		logins:     make(chan *Login),
+		sessions:   make(map[string]*Session),
+		history:    history,
 	}
 	newLob.Listen()
 	return newLob
@@ -179,9 +357,11 @@ func (lob *Lobby) Listen() {
 			case client := <-lob.joinRoom:
 				lob.JoinRoom(client)
 			case client := <-lob.leaveRoom:
-				lob.LeaveCRoom(client)
-			case cRoom := <-lob.delRoom:
-				lob.DeleteCRoom(cRoom)
+				lob.Leave(client)
+			case login := <-lob.logins:
+				lob.FinishLogin(login)
+			case <-lob.scheduler.Wake():
+				lob.scheduler.Run()
 			}
 		}
 	}()
@@ -196,10 +376,28 @@ func (lob *Lobby) JoinRoom(client *Client) {
 		client.Quit()
 		return
 	}
+	/*A certificate may have named them already, the name still has to be
+	* as free as one picked with !name.*/
+	certName := ""
+	if client.username != CNAME && (lob.users.Registered(client.username) ||
+		lob.FindClient(client.username) != nil || lob.HeldFor(client.username) != "") {
+		certName = client.username
+		client.username = CNAME
+	}
+	/*Give guests a name of their own.*/
+	if client.username == CNAME {
+		client.username = lob.GuestName()
+	}
 	/*Add user to array of users.*/
 	lob.curClients = append(lob.curClients, client)
 	/*Add the welcome message to the clients structure.*/
 	client.outMsg <- SCONNECT
+	if certName != "" {
+		client.outMsg <- fmt.Sprintf(ERR_CERTNAME, certName)
+		log.Println("Client's certificate name was taken.")
+	}
+	client.token = NewToken()
+	client.outMsg <- fmt.Sprintf(NOTE_TOKEN, RESUMETIME, client.token)
 	/*Add the latest incoming message to the lobby, for each client.*/
 	go func() {
 		for msg := range client.incMsg {
@@ -209,11 +407,22 @@ func (lob *Lobby) JoinRoom(client *Client) {
 	}()
 }
 
-/*This function will handle leaving a room.*/
+/*This function will handle leaving a room. Unless they quit, their name
+* and rooms are held in case they reconnect.*/
 func (lob *Lobby) Leave(client *Client) {
-	/*If the client is in a room, leave.*/
-	if client.cRoom != nil {
-		client.cRoom.Leave(client)
+	var session *Session
+	if client.token != "" && !client.quitting {
+		session = &Session{
+			username: client.username,
+			account:  client.account,
+			cRooms:   append([]*CRoom(nil), client.cRooms...),
+			cRoom:    client.cRoom,
+			seen:     make(map[*CRoom]int),
+		}
+	}
+	/*If the client is in any rooms, leave them all.*/
+	for len(client.cRooms) > 0 {
+		client.cRooms[0].Leave(client)
 	}
 	/*Add the user back to the lobby clients.*/
 	for k, oClient := range lob.curClients {
@@ -224,35 +433,251 @@ func (lob *Lobby) Leave(client *Client) {
 	}
 	close(client.outMsg)
 	log.Println("Closed the outgoing channel for the client.")
+	if session != nil {
+		/*Counted after leaving, so they aren't sent their own leave notes.*/
+		for _, cRoom := range session.cRooms {
+			session.seen[cRoom] = cRoom.sent
+		}
+		session.expireEntry = lob.scheduler.After(RESUMETIME, func() {
+			delete(lob.sessions, client.token)
+		})
+		lob.sessions[client.token] = session
+	}
+}
+
+/*Find the token of a dropped user holding the name, empty if nobody is.*/
+func (lob *Lobby) HeldFor(username string) string {
+	for token, session := range lob.sessions {
+		if session.username == username {
+			return token
+		}
+	}
+	return ""
+}
+
+/*Forget a held session, so it can't be resumed.*/
+func (lob *Lobby) DropSession(token string) {
+	if session := lob.sessions[token]; session != nil {
+		lob.scheduler.Cancel(session.expireEntry)
+		delete(lob.sessions, token)
+	}
+}
+
+/*Give the user the name and rooms of the dropped connection the token was
+* handed to, along with what was said in those rooms while they were gone.
+* Rooms archived in the meantime are skipped.*/
+func (lob *Lobby) Resume(client *Client, token string) {
+	session := lob.sessions[token]
+	if session == nil {
+		client.outMsg <- ERR_RESUME
+		log.Println("User tried to resume with a bad token.")
+		return
+	}
+	lob.DropSession(token)
+	client.account = session.account
+	if client.username != session.username {
+		lob.ChangeUsername(client, session.username)
+	}
+	for _, cRoom := range session.cRooms {
+		if lob.cRoom[cRoom.cName] != cRoom || client.FindCRoom(cRoom.cName) != nil {
+			continue
+		}
+		missed := cRoom.msgs
+		if n := cRoom.sent - session.seen[cRoom]; n < len(missed) {
+			missed = missed[len(missed)-n:]
+		}
+		for _, msg := range missed {
+			client.outMsg <- msg
+		}
+		client.before[cRoom] = cRoom.sent - len(missed)
+		client.cRooms = append(client.cRooms, cRoom)
+		cRoom.curClients = append(cRoom.curClients, client)
+		cRoom.Broadcast(fmt.Sprintf(NOTE_ROOM_BACK, client.username))
+	}
+	if session.cRoom != nil && client.FindCRoom(session.cRoom.cName) == session.cRoom {
+		client.cRoom = session.cRoom
+	} else if len(client.cRooms) > 0 {
+		client.cRoom = client.cRooms[len(client.cRooms)-1]
+	}
+	client.outMsg <- fmt.Sprintf(NOTE_RESUMED, client.username)
+	log.Println("User resumed their session.")
+}
+
+/*A random resume token, in hex.*/
+func NewToken() string {
+	token := make([]byte, TOKENSIZE)
+	if _, errNo := rand.Read(token); errNo != nil {
+		log.Println("Error: ", errNo)
+		os.Exit(1)
+	}
+	return hex.EncodeToString(token)
+}
+
+/*Check the room once it is due to expire, and warn the users in it a while
+* before that.*/
+func (lob *Lobby) ScheduleCRoom(cRoom *CRoom) {
+	cRoom.expireEntry = lob.scheduler.At(cRoom.expire, func() {
+		lob.DeleteCRoom(cRoom)
+	})
+	cRoom.warnEntry = lob.scheduler.At(cRoom.expire.Add(-WARNTIME), func() {
+		lob.WarnCRoom(cRoom)
+	})
+}
+
+/*Tell the users in a room it is about to be archived, unless it has been
+* used since the warning was set.*/
+func (lob *Lobby) WarnCRoom(cRoom *CRoom) {
+	warnAt := cRoom.expire.Add(-WARNTIME)
+	if warnAt.After(lob.scheduler.Now()) {
+		lob.scheduler.Reschedule(cRoom.warnEntry, warnAt)
+		return
+	}
+	left := cRoom.expire.Sub(lob.scheduler.Now()).Round(time.Second)
+	cRoom.Notify(fmt.Sprintf(NOTE_ROOM_WARN, left))
 }
 
 /*Delete will check if a certain channel has expired, if so the room will be
-* deleted. Otherwise, a signal will be sent to the channel to be deleted
-* for its new expiry time.*/
+* archived. Otherwise, it is checked again at its new expiry time.*/
 func (lob *Lobby) DeleteCRoom(cRoom *CRoom) {
-	if cRoom.expire.After(time.Now()) {
-		go func() {
-			time.Sleep(cRoom.expire.Sub(time.Now()))
-			lob.delRoom <- cRoom
-		}()
+	if cRoom.expire.After(lob.scheduler.Now()) {
+		lob.scheduler.Reschedule(cRoom.expireEntry, cRoom.expire)
+		/*Warn again if the room was used after the last warning.*/
+		if warnAt := cRoom.expire.Add(-WARNTIME); warnAt.After(lob.scheduler.Now()) {
+			lob.scheduler.Reschedule(cRoom.warnEntry, warnAt)
+		}
 		log.Println("Attempted to delete a chat room.")
 	} else {
-		cRoom.Delete()
+		lob.scheduler.Cancel(cRoom.warnEntry)
+		cRoom.Archive()
+		cRoom.archivedAt = lob.scheduler.Now()
 		delete(lob.cRoom, cRoom.cName)
-		log.Println("Deleted the room successfully.")
+		lob.archived[cRoom.cName] = cRoom
+		cRoom.purgeEntry = lob.scheduler.After(ARCHTIME, func() {
+			lob.PurgeCRoom(cRoom)
+		})
+		lob.TrimArchived()
+		log.Println("Archived the room successfully.")
+	}
+}
+
+/*Forget an archived room and its history, so the name is free again.*/
+func (lob *Lobby) PurgeCRoom(cRoom *CRoom) {
+	lob.scheduler.Cancel(cRoom.purgeEntry)
+	delete(lob.archived, cRoom.cName)
+	log.Println("Purged an archived room.")
+}
+
+/*Purge the oldest archived rooms until there are no more than ARCHMAX.
+* Rooms archived together go by which was used last.*/
+func (lob *Lobby) TrimArchived() {
+	for len(lob.archived) > ARCHMAX {
+		var oldest *CRoom
+		for _, cRoom := range lob.archived {
+			switch {
+			case oldest == nil, cRoom.archivedAt.Before(oldest.archivedAt):
+				oldest = cRoom
+			case cRoom.archivedAt.Equal(oldest.archivedAt) && cRoom.expire.Before(oldest.expire):
+				oldest = cRoom
+			}
+		}
+		lob.PurgeCRoom(oldest)
+	}
+}
+
+/*List the rooms that were archived, and when.*/
+func (lob *Lobby) ListArchived(client *Client) {
+	client.outMsg <- "\n\n"
+	client.outMsg <- "Archived Chat Rooms:\n"
+	for cName, cRoom := range lob.archived {
+		client.outMsg <- fmt.Sprintf("%s - archived %s, %d messages\n", cName, cRoom.archivedAt.Format(time.RFC822), len(cRoom.msgs))
 	}
+	client.outMsg <- "\n"
+	log.Println("Client listed the archived chat rooms.")
 }
 
-/*This function will remove a user from the current chat room, and will check
-* if they are already in a room.*/
-func (lob *Lobby) LeaveCRoom(client *Client) {
-	if client.cRoom == nil {
+/*Bring an archived room back, history and all, with a fresh expiry.*/
+func (lob *Lobby) RestoreCRoom(client *Client, cRoomName string) {
+	cRoom := lob.archived[cRoomName]
+	if cRoom == nil {
+		client.outMsg <- ERR_RESTORE
+		return
+	}
+	lob.scheduler.Cancel(cRoom.purgeEntry)
+	delete(lob.archived, cRoomName)
+	cRoom.archivedAt = time.Time{}
+	cRoom.expire = lob.scheduler.Now().Add(EXTIME)
+	lob.cRoom[cRoomName] = cRoom
+	lob.ScheduleCRoom(cRoom)
+	client.outMsg <- fmt.Sprintf(NOTE_ROOM_RESTORE, cRoomName)
+	log.Println("User restored an archived chat room.")
+}
+
+/*This function will remove a user from the named chat room, or the one they
+* are talking in, and will check if they are already in a room.*/
+func (lob *Lobby) LeaveCRoom(client *Client, cRoomName string) {
+	cRoom := client.cRoom
+	if cRoomName != "" {
+		cRoom = client.FindCRoom(cRoomName)
+		if cRoom == nil {
+			client.outMsg <- fmt.Sprintf(ERR_NOTIN, cRoomName)
+			return
+		}
+	}
+	if cRoom == nil {
 		client.outMsg <- ERR_LEAVE
-		log.Println("Error in making a user leave a room.\n")
+		log.Println("Error in making a user leave a room.")
 		return
 	}
-	client.cRoom.Leave(client)
-	log.Println("Succesfully made user leave a chat room!\n")
+	cRoom.Leave(client)
+	log.Println("Succesfully made user leave a chat room!")
+}
+
+/*Page back through the room the user is talking in, from the oldest message
+* they have been shown.*/
+func (lob *Lobby) History(client *Client, args []string) {
+	cRoom := client.cRoom
+	n := lob.history.Replay
+	if len(args) > 0 {
+		count, errNo := strconv.Atoi(args[0])
+		if errNo != nil || count < 1 {
+			client.outMsg <- ERR_HISTORY
+			return
+		}
+		n = count
+	}
+	if cRoom == nil {
+		client.outMsg <- ERR_HISTORY
+		return
+	}
+	/*Rooms that replay everything page back through everything too.*/
+	if n < 1 {
+		n = len(cRoom.msgs)
+	}
+	msgs, start := cRoom.Before(client.before[cRoom], n)
+	if len(msgs) == 0 {
+		client.outMsg <- fmt.Sprintf(NOTE_HISTORY_END, cRoom.cName)
+		return
+	}
+	client.outMsg <- "================BEGIN LOG================\n"
+	for _, msg := range msgs {
+		client.outMsg <- msg
+	}
+	client.outMsg <- "================END LOG================\n"
+	client.before[cRoom] = start
+	log.Println("User paged back through a room's history.")
+}
+
+/*Users can be in several rooms at once, this picks the one their messages
+* go to.*/
+func (lob *Lobby) SwitchCRoom(client *Client, cRoomName string) {
+	cRoom := client.FindCRoom(cRoomName)
+	if cRoom == nil {
+		client.outMsg <- fmt.Sprintf(ERR_NOTIN, cRoomName)
+		return
+	}
+	client.cRoom = cRoom
+	client.outMsg <- fmt.Sprintf(NOTE_ROOM_SWITCH, cRoom.cName)
+	log.Println("User switched to another room.")
 }
 
 /*We need a function to join chat. Will try and join a user to a room,
@@ -264,10 +689,11 @@ func (lob *Lobby) EnterCRoom(client *Client, cRoomName string) {
 		log.Println("Attempted to add user to a room that doesn't exist.\n")
 		return
 	}
-	/*Check if user doesn't have a room in their current state.*/
-	/*If so, just leave their old chat room to join this one.*/
-	if client.cRoom != nil {
-		lob.LeaveCRoom(client)
+	/*If the user is already in the room, just start talking in it. They stay
+	* in their other rooms either way.*/
+	if client.FindCRoom(cRoomName) != nil {
+		lob.SwitchCRoom(client, cRoomName)
+		return
 	}
 	lob.cRoom[cRoomName].Join(client)
 	log.Println("Successfully added user to another room.")
@@ -285,13 +711,14 @@ func (lob *Lobby) CreateCRoom(client *Client, cRoomName string) {
 		log.Println("User tried to create a room with a name that is already in use.\n")
 		return
 	}
+	if lob.archived[cRoomName] != nil {
+		client.outMsg <- fmt.Sprintf(ERR_ARCHIVED, cRoomName)
+		return
+	}
 	/*Create a new chat room, add it to the chat room lobby channel.*/
-	cRoom := NewCRoom(cRoomName)
+	cRoom := NewCRoom(cRoomName, lob.scheduler.Clock(), lob.history)
 	lob.cRoom[cRoomName] = cRoom
-	go func() {
-		time.Sleep(EXTIME)
-		lob.delRoom <- cRoom
-	}()
+	lob.ScheduleCRoom(cRoom)
 	client.outMsg <- fmt.Sprintf(NOTE_ROOM_CREATE, cRoom.cName)
 	lob.EnterCRoom(client, cRoomName)
 	log.Println("User created a new chat room!\n")
@@ -310,25 +737,183 @@ func (lob *Lobby) SendMsg(msg *Msg) {
 	log.Println("Sucess on sending client message.")
 }
 
-/*Changes the clients name to a given different name.*/
+/*Changes the clients name to a given different name. Registered names are
+* only for whoever logged in with them.*/
 func (lob *Lobby) ChangeUsername(client *Client, username string) {
-	if client.cRoom == nil {
+	if client.account != username && lob.users.Registered(username) {
+		client.outMsg <- fmt.Sprintf(ERR_RESERVED, username, username)
+		log.Println("User tried to take a registered name.")
+		return
+	}
+	if other := lob.FindClient(username); (other != nil && other != client) || lob.HeldFor(username) != "" {
+		client.outMsg <- fmt.Sprintf(ERR_TAKEN, username)
+		log.Println("User tried to take a name someone else is using.")
+		return
+	}
+	if len(client.cRooms) == 0 {
 		client.outMsg <- fmt.Sprintf(NOTE_CHANGENAME, username)
-	} else {
-		client.cRoom.Broadcast(fmt.Sprintf(NOTE_PUB_CHANGENAME, client.username, username))
+	}
+	for _, cRoom := range client.cRooms {
+		cRoom.Broadcast(fmt.Sprintf(NOTE_PUB_CHANGENAME, client.username, username))
 	}
 	client.username = username
 	log.Println("Success on client changing name!\n")
 }
 
-/*List all the current chat rooms that are active to the user.*/
-func (lob *Lobby) ListCRooms(client *Client) {
-	/*Throw in a new line for relob.Help(msg.client)factor purposes.*/
+/*Find the connected user with the name.*/
+func (lob *Lobby) FindClient(username string) *Client {
+	for _, client := range lob.curClients {
+		if client.username == username {
+			return client
+		}
+	}
+	return nil
+}
+
+/*Hand out the next free guest name, Anon1, Anon2 and so on.*/
+func (lob *Lobby) GuestName() string {
+	for {
+		lob.guests++
+		username := CNAME + strconv.Itoa(lob.guests)
+		if lob.FindClient(username) == nil && lob.HeldFor(username) == "" && !lob.users.Registered(username) {
+			return username
+		}
+	}
+}
+
+/*Register a name for the user, which logs them in as it. Nobody else can
+* be using it.*/
+func (lob *Lobby) Register(client *Client, username string, password string) {
+	if username == "" || username == CNAME {
+		client.outMsg <- fmt.Sprintf(ERR_REGISTER, "pick a name")
+		return
+	}
+	if other := lob.FindClient(username); other != nil && other != client {
+		client.outMsg <- fmt.Sprintf(ERR_TAKEN, username)
+		return
+	}
+	if !lob.StartHashing(client) {
+		return
+	}
+	go func() {
+		errNo := lob.users.Register(username, password)
+		lob.logins <- &Login{client: client, name: username, register: true, errNo: errNo}
+	}()
+}
+
+/*Check the password for a registered name off the lobby thread.*/
+func (lob *Lobby) Login(client *Client, username string, password string) {
+	if !lob.StartHashing(client) {
+		return
+	}
+	go func() {
+		ok := lob.users.Login(username, password)
+		lob.logins <- &Login{client: client, name: username, ok: ok}
+	}()
+}
+
+/*Whether the user can have a password checked now. They wait for the one
+* they already sent, and an address that keeps getting it wrong waits out
+* its backoff.*/
+func (lob *Lobby) StartHashing(client *Client) bool {
+	if client.hashing {
+		client.outMsg <- ERR_LOGINBUSY
+		return false
+	}
+	if wait := lob.users.Backoff(client.Host()); wait > 0 {
+		client.outMsg <- fmt.Sprintf(ERR_LOGINWAIT, wait.Round(time.Second))
+		log.Println("User tried to log in during their backoff.")
+		return false
+	}
+	client.hashing = true
+	return true
+}
+
+/*Back on the lobby thread, give the user their name. A guest using it gets
+* moved off it.*/
+func (lob *Lobby) FinishLogin(login *Login) {
+	client := login.client
+	client.hashing = false
+	connected := false
+	for _, oClient := range lob.curClients {
+		connected = connected || oClient == client
+	}
+	if !connected {
+		return
+	}
+	if login.register {
+		if login.errNo != nil {
+			client.outMsg <- fmt.Sprintf(ERR_REGISTER, login.errNo)
+			return
+		}
+		client.outMsg <- fmt.Sprintf(NOTE_REGISTERED, login.name, login.name)
+	} else if !login.ok {
+		lob.users.Failed(client.Host())
+		client.outMsg <- ERR_LOGIN
+		log.Println("User failed to log in.")
+		return
+	}
+	/*Whoever dropped holding the name can't have it back now.*/
+	if token := lob.HeldFor(login.name); token != "" {
+		lob.DropSession(token)
+	}
+	if other := lob.FindClient(login.name); other != nil && other != client {
+		other.outMsg <- fmt.Sprintf(NOTE_BUMPED, login.name)
+		other.account = ""
+		lob.ChangeUsername(other, lob.GuestName())
+	}
+	client.account = login.name
+	if client.username != login.name {
+		lob.ChangeUsername(client, login.name)
+	}
+	lob.users.Succeeded(client.Host())
+	client.outMsg <- fmt.Sprintf(NOTE_LOGIN, login.name)
+	log.Println("User logged in.")
+}
+
+/*List all the current chat rooms that are active to the user, with how many
+* are in them and when they were last used. Args can be a pattern like dev-*
+* and how to sort them, by name, most recently active or most users.*/
+func (lob *Lobby) ListCRooms(client *Client, args []string) {
+	order, pattern := LIST_NAME, "*"
+	for _, arg := range args {
+		switch arg {
+		case LIST_NAME, LIST_ACTIVE, LIST_SIZE:
+			order = arg
+		default:
+			pattern = arg
+		}
+	}
+	if _, errNo := filepath.Match(pattern, ""); errNo != nil {
+		client.outMsg <- fmt.Sprintf(ERR_PATTERN, pattern)
+		return
+	}
+	cRooms := make([]*CRoom, 0, len(lob.cRoom))
+	for cName, cRoom := range lob.cRoom {
+		if matched, _ := filepath.Match(pattern, cName); matched {
+			cRooms = append(cRooms, cRoom)
+		}
+	}
+	/*Map order changes every time, so sort them, falling back on the name.*/
+	sort.Slice(cRooms, func(i, j int) bool {
+		a, b := cRooms[i], cRooms[j]
+		switch {
+		case order == LIST_ACTIVE && !a.expire.Equal(b.expire):
+			return a.expire.After(b.expire)
+		case order == LIST_SIZE && len(a.curClients) != len(b.curClients):
+			return len(a.curClients) > len(b.curClients)
+		}
+		return a.cName < b.cName
+	})
+
+	/*Throw in a new line for refactor purposes.*/
 	client.outMsg <- "\n\n"
 	client.outMsg <- "Chat Rooms:\n"
+	now := lob.scheduler.Now()
 	/*Print out all the rooms, through a for loop.*/
-	for cName := range lob.cRoom {
-		client.outMsg <- fmt.Sprintf("%s\n", cName)
+	for _, cRoom := range cRooms {
+		client.outMsg <- fmt.Sprintf("%s - %d online, active %s, expires in %s\n", cRoom.cName, len(cRoom.curClients),
+			cRoom.expire.Add(-EXTIME).Format(LIST_TIME), cRoom.expire.Sub(now).Round(time.Minute))
 	}
 	client.outMsg <- "\n"
 	log.Println("Client sucess on listing chat rooms.\n")
@@ -341,11 +926,18 @@ func (lob *Lobby) Help(client *Client) {
 	client.outMsg <- "\n\n"
 	client.outMsg <- "Commands and Usage:\n"
 	client.outMsg <- "!help - lists all commands.\n"
-	client.outMsg <- "!list - lists all chat rooms that are active.\n"
+	client.outMsg <- "!list [dev-*] [name|active|size] - lists chat rooms matching dev-*, sorted by name, activity or size.\n"
 	client.outMsg <- "!name param - changes your name to param.\n"
+	client.outMsg <- "!register name password - registers name so only you can use it.\n"
+	client.outMsg <- "!login name password - takes back your registered name.\n"
+	client.outMsg <- "!resume token - takes back your name and channels after losing your connection.\n"
 	client.outMsg <- "!create chan - creates a channel called chan.\n"
-	client.outMsg <- "!enter chan - enters a chat named chan.\n"
-	client.outMsg <- "!leave - leaves the current channel.\n"
+	client.outMsg <- "!enter chan - enters a chat named chan, staying in the others.\n"
+	client.outMsg <- "!leave [chan] - leaves chan, or the channel you are talking in.\n"
+	client.outMsg <- "!switch chan or !w chan - talks in chan, one of the channels you are in.\n"
+	client.outMsg <- fmt.Sprintf("!archives - lists channels archived for being inactive, kept for %d days.\n", ARCHTIME/(24*time.Hour))
+	client.outMsg <- "!restore chan - brings back the archived channel chan.\n"
+	client.outMsg <- "!history [n] - shows the messages before the oldest you have seen in your channel, n of them at a time.\n"
 	client.outMsg <- "!quit - quits the chat client.\n"
 	client.outMsg <- "\n\n"
 	log.Println("User accessed the help section.\n")
@@ -362,15 +954,46 @@ func (lob *Lobby) ParseMsg(msg *Msg) {
 		cName := strings.TrimSuffix(strings.TrimPrefix(msg.txt, COMM_ENTERROOM+" "), "\n")
 		lob.EnterCRoom(msg.client, cName)
 	case strings.HasPrefix(msg.txt, COMM_LEAVEROOM):
-		lob.LeaveCRoom(msg.client)
+		cName := strings.TrimSpace(strings.TrimPrefix(msg.txt, COMM_LEAVEROOM))
+		lob.LeaveCRoom(msg.client, cName)
+	case strings.HasPrefix(msg.txt, COMM_SWITCHROOM):
+		cName := strings.TrimSpace(strings.TrimPrefix(msg.txt, COMM_SWITCHROOM))
+		lob.SwitchCRoom(msg.client, cName)
+	case strings.HasPrefix(msg.txt, COMM_SHORTSWITCH):
+		cName := strings.TrimSpace(strings.TrimPrefix(msg.txt, COMM_SHORTSWITCH))
+		lob.SwitchCRoom(msg.client, cName)
+	case strings.HasPrefix(msg.txt, COMM_ARCHIVES):
+		lob.ListArchived(msg.client)
+	case strings.HasPrefix(msg.txt, COMM_RESTORE):
+		cName := strings.TrimSpace(strings.TrimPrefix(msg.txt, COMM_RESTORE))
+		lob.RestoreCRoom(msg.client, cName)
 	case strings.HasPrefix(msg.txt, COMM_LISTROOMS):
-		lob.ListCRooms(msg.client)
+		lob.ListCRooms(msg.client, strings.Fields(strings.TrimPrefix(msg.txt, COMM_LISTROOMS)))
+	case strings.HasPrefix(msg.txt, COMM_HISTORY):
+		lob.History(msg.client, strings.Fields(strings.TrimPrefix(msg.txt, COMM_HISTORY)))
 	case strings.HasPrefix(msg.txt, COMM_HELPCHAT):
 		lob.Help(msg.client)
+	case strings.HasPrefix(msg.txt, COMM_REGISTER):
+		args := strings.Fields(strings.TrimPrefix(msg.txt, COMM_REGISTER))
+		if len(args) != 2 {
+			msg.client.outMsg <- fmt.Sprintf(ERR_REGISTER, "give a name and a password")
+			return
+		}
+		lob.Register(msg.client, args[0], args[1])
+	case strings.HasPrefix(msg.txt, COMM_LOGIN):
+		args := strings.Fields(strings.TrimPrefix(msg.txt, COMM_LOGIN))
+		if len(args) != 2 {
+			msg.client.outMsg <- ERR_LOGIN
+			return
+		}
+		lob.Login(msg.client, args[0], args[1])
+	case strings.HasPrefix(msg.txt, COMM_RESUME):
+		lob.Resume(msg.client, strings.TrimSpace(strings.TrimPrefix(msg.txt, COMM_RESUME)))
 	case strings.HasPrefix(msg.txt, COMM_CHANGENAME):
 		username := strings.TrimSuffix(strings.TrimPrefix(msg.txt, COMM_CHANGENAME+" "), "\n")
 		lob.ChangeUsername(msg.client, username)
 	case strings.HasPrefix(msg.txt, COMM_QUITCHAT):
+		msg.client.quitting = true
 		msg.client.Quit()
 	default:
 		lob.SendMsg(msg)
@@ -384,16 +1007,31 @@ type CRoom struct {
 	cName      string
 	curClients []*Client
 	msgs       []string
+	msgBytes   int
+	/*Messages sent since the room was made, msgs only keeps the newest.*/
+	sent int
 	expire     time.Time
+	/*The scheduler entry that checks the expiry, and the clock it runs on.*/
+	expireEntry *util.ScheduleEntry
+	clock       util.Clock
+	/*How much history it keeps and replays, shared with the lobby.*/
+	history *HistoryConfig
+	/*Warns the users before it expires, and when it was archived.*/
+	warnEntry  *util.ScheduleEntry
+	archivedAt time.Time
+	/*Drops it for good once it has been archived for ARCHTIME.*/
+	purgeEntry *util.ScheduleEntry
 }
 
 /*Creation of a new chat room, simply return a room with a given string.*/
-func NewCRoom(cName string) *CRoom {
+func NewCRoom(cName string, clock util.Clock, history *HistoryConfig) *CRoom {
 	return &CRoom{
 		cName:      cName,
 		curClients: make([]*Client, 0),
 		msgs:       make([]string, 0),
-		expire:     time.Now().Add(EXTIME),
+		expire:     clock.Now().Add(EXTIME),
+		clock:      clock,
+		history:    history,
 	}
 }
 
@@ -401,39 +1039,84 @@ func NewCRoom(cName string) *CRoom {
 * outmsg of a client, to each user within it's channel.*/
 func (cRoom *CRoom) Broadcast(msg string) {
 	/*Rooms been accessed, increase the time of expiry.*/
-	cRoom.expire = time.Now().Add(EXTIME)
+	cRoom.expire = cRoom.clock.Now().Add(EXTIME)
+	/*Users can be in several rooms, so tag it with the room it came from.*/
+	msg = fmt.Sprintf("{%s} %s", cRoom.cName, msg)
 	cRoom.msgs = append(cRoom.msgs, msg)
+	cRoom.msgBytes += len(msg)
+	cRoom.sent++
+	/*Drop the oldest messages once the room is holding too many.*/
+	for cRoom.TooMuchHistory() {
+		cRoom.msgBytes -= len(cRoom.msgs[0])
+		cRoom.msgs = cRoom.msgs[1:]
+	}
 	for _, client := range cRoom.curClients {
 		client.outMsg <- msg
 	}
 }
 
-/*Now we need to make functions for creation, deletion and joining of different
-* chat rooms. Delete will simply notify that the channel is going to be
-* deleted due to inactivity.*/
-func (cRoom *CRoom) Delete() {
-	/*If there's people in the room, notify of deletion.*/
-	/*Basically need to rewrite function on inside, or it will renew the
-	* room.*/
-	//cRoom.Broadcast(NOTE_ROOM_DELETION)
+/*Whether the room is keeping more messages than it should, it always keeps
+* the newest one.*/
+func (cRoom *CRoom) TooMuchHistory() bool {
+	maxMsgs, maxBytes := cRoom.history.MaxMessages, cRoom.history.MaxBytes
+	return (maxMsgs > 0 && len(cRoom.msgs) > maxMsgs) ||
+		(maxBytes > 0 && len(cRoom.msgs) > 1 && cRoom.msgBytes > maxBytes)
+}
+
+/*The n messages the room still has from before the given one, counting
+* every message since the room was made, and the count the first of them is.*/
+func (cRoom *CRoom) Before(before int, n int) ([]string, int) {
+	oldest := cRoom.sent - len(cRoom.msgs)
+	if before > cRoom.sent {
+		before = cRoom.sent
+	}
+	start := before - n
+	if start < oldest {
+		start = oldest
+	}
+	if start >= before {
+		return nil, before
+	}
+	return cRoom.msgs[start-oldest : before-oldest], start
+}
+
+/*Send to the users in the room without keeping the message or renewing
+* the room, for notices about the room itself.*/
+func (cRoom *CRoom) Notify(msg string) {
+	msg = fmt.Sprintf("{%s} %s", cRoom.cName, msg)
 	for _, client := range cRoom.curClients {
-		client.cRoom = nil
+		client.outMsg <- msg
+	}
+}
+
+/*Now we need to make functions for creation, archiving and joining of different
+* chat rooms. Archive will notify that the channel is going away due to
+* inactivity and empty it, the history stays for when it is restored.*/
+func (cRoom *CRoom) Archive() {
+	/*If there's people in the room, notify them, without renewing the room.*/
+	cRoom.Notify(fmt.Sprintf(NOTE_ROOM_DELETION, cRoom.cName))
+	for _, client := range cRoom.curClients {
+		client.Forget(cRoom)
 	}
-	//cRoom.curClients = nil
-	//cRoom.msgs = nil
-	//cRoom.expire = nil
+	cRoom.curClients = make([]*Client, 0)
 }
 
 /*When a user joins a room, we want to notify the people that he has joined.
 * Also, set his room to his chat room, and give him the history of messages
-* as he joins.*/
+* as he joins, only the last few so a busy room doesn't flood him.*/
 func (cRoom *CRoom) Join(client *Client) {
 	client.cRoom = cRoom
+	client.cRooms = append(client.cRooms, cRoom)
+	backlog := cRoom.msgs
+	if replay := cRoom.history.Replay; replay > 0 && len(backlog) > replay {
+		backlog = backlog[len(backlog)-replay:]
+	}
+	client.before[cRoom] = cRoom.sent - len(backlog)
 	if len(cRoom.msgs) != 0 {
 		client.outMsg <- "================BEGIN LOG================\n"
 	}
 
-	for _, msg := range cRoom.msgs {
+	for _, msg := range backlog {
 		client.outMsg <- msg
 	}
 	if len(cRoom.msgs) != 0 {
@@ -454,7 +1137,7 @@ func (cRoom *CRoom) Leave(client *Client) {
 			break
 		}
 	}
-	client.cRoom = nil
+	client.Forget(cRoom)
 }
 
 /*Messages are the structure that is a part of the chat room, which chat rooms
@@ -487,9 +1170,15 @@ func (msg *Msg) toString() string {
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	lob := NewLobby()
+	users, errNo := util.LoadUsers(util.USERS_FILE)
+	if errNo != nil {
+		log.Println("Error: ", errNo)
+		os.Exit(1)
+	}
+	lob := NewLobby(util.SystemClock{}, users, LoadHistoryConfig())
+	props := util.LoadTLSConfig()
 
-	listen, errNo := net.Listen(TYPE, HOST+PORT)
+	listen, errNo := util.Listen(TYPE, HOST+PORT, props)
 	if errNo != nil {
 		log.Println("Error: ", errNo)
 		os.Exit(1)
@@ -503,6 +1192,15 @@ func main() {
 			log.Println("Error: ", errNo)
 			continue
 		}
-		lob.JoinRoom(ClientConstruct(connect))
+		/*Finish the TLS handshake off the accept loop, with mutual TLS the
+		* name on the client certificate becomes the username.*/
+		go func(connect net.Conn) {
+			certName := util.PeerName(connect)
+			client := ClientConstruct(connect)
+			if certName != "" {
+				client.username = certName
+			}
+			lob.joinRoom <- client
+		}(connect)
 	}
 }
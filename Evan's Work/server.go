@@ -6,12 +6,13 @@ package main
 // an error checker, encoding and decoding characters, logging, etc.
 // A major amount of work will be done within utils.
 import (
+	"./endpoint/stream"
 	"./util"
 	"bufio"
 	"fmt"
-	"net"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // Array of rooms to list.
@@ -19,16 +20,25 @@ var rooms = [10]string{"lobby", "", "", "", "", "", "", "", "", ""}
 
 const MAINLOBBY = "lobby"
 
+// Registered names, only someone with the password can use one.
+var users *util.UserStore
+
 func main() {
 	// Possible we can make a file to load properites.
 	props := util.LoadConfig()
+	var errNo error
+	users, errNo = util.LoadUsers(util.USERS_FILE)
+	util.CheckForError(errNo, "Cannot read the user store")
 	// This is for the tcp sockets.
-	pSocket, pError := net.Listen("tcp", ":"+props.Port)
+	pSocket, pError := util.Listen("tcp", ":"+props.Port, props.TLS)
 	util.CheckForError(pError, "Cannot create a server!")
 
 	// Have some output stating whether server gets started.
 	fmt.Printf("Chat server %v has begun on port %v...\n", props.Host, props.Port)
 
+	// Live room feeds over HTTP, for clients that can't reach the TCP port.
+	go stream.Start(users)
+
 	// Server has to have a simple loop to keep running, it will forever
 	// listen until a user joins, then will wait for user input.
 	for {
@@ -73,6 +83,25 @@ func waitForUserIn(output chan string, client *util.Client) {
 	}
 }
 
+// Check a password for a registered name. Each client's input is handled on
+// its own goroutine one line at a time, so they only ever have one password
+// being hashed. An address that keeps getting it wrong is told to wait,
+// otherwise a wrong password gets the failed reply.
+func checkLogin(name string, password string, client *util.Client, failed string) bool {
+	addr := util.HostOf(client.UserConnection.RemoteAddr().String())
+	if wait := users.Backoff(addr); wait > 0 {
+		util.SendClientReply("loginwait", name, wait.Round(time.Second).String(), client)
+		return false
+	}
+	if !users.Login(name, password) {
+		users.Failed(addr)
+		util.SendClientReply(failed, name, "", client)
+		return false
+	}
+	users.Succeeded(addr)
+	return true
+}
+
 // Now we can listen for user input, and handle in specific cases. For our current assignment 1
 // we can use creation of rooms, joining, list, and sending messages to a room, and leave rooms.
 func HandleUserInput(input <-chan string, client *util.Client, props util.Properties) {
@@ -91,11 +120,46 @@ func HandleUserInput(input <-chan string, client *util.Client, props util.Proper
 				// user sends a message.
 				case "message":
 					util.SendClientMessage("message", body, client, false, props)
-				// user provides their username.
+				// user provides their username, and a password if it is registered.
 				case "user":
-					client.User = body
+					name, password := splitArgs(body)
+					// With mutual TLS the certificate decides who you are.
+					if certName := util.PeerName(client.UserConnection); certName != "" {
+						name = certName
+					} else if users.Registered(name) && !checkLogin(name, password, client, "reserved") {
+						continue
+					}
+					// Nobody else can be using the name.
+					if other := util.FindUser(name); name == "" || (other != nil && other != client) {
+						util.SendClientReply("nametaken", name, "", client)
+						continue
+					}
+					client.SetUser(name)
 					util.SendClientMessage("connect", "", client, false, props)
 
+				// user registers a name, which becomes theirs.
+				case "register":
+					name, password := splitArgs(body)
+					if name == "" || (name != client.User && util.FindUser(name) != nil) {
+						util.SendClientReply("registerfailed", name, "someone is using that name", client)
+						continue
+					}
+					if errNo := users.Register(name, password); errNo != nil {
+						util.SendClientReply("registerfailed", name, errNo.Error(), client)
+						continue
+					}
+					client.SetUser(name)
+					util.SendClientReply("registered", name, "", client)
+
+				// user takes back a registered name.
+				case "login":
+					name, password := splitArgs(body)
+					if !checkLogin(name, password, client, "loginfailed") {
+						continue
+					}
+					client.SetUser(name)
+					util.SendClientReply("loggedin", name, "", client)
+
 				// The user disconnects.
 				case "disconnect":
 					client.Close(false)
@@ -104,7 +168,7 @@ func HandleUserInput(input <-chan string, client *util.Client, props util.Proper
 				case "enter":
 					// Make sure body (anything after /case is not empty.
 					if body != "" {
-						client.Room = body
+						client.Enter(body)
 						//fmt.Printf("%s", rooms[0])
 						util.SendClientMessage("enter", body, client, false, props)
 						for i := range rooms {
@@ -129,21 +193,40 @@ func HandleUserInput(input <-chan string, client *util.Client, props util.Proper
 
 				// Print out the list of rooms.
 
-				// User leaves the current room.
+				// User leaves the named room, or the current one.
 				case "leave":
+					if body == "" {
+						body = client.Room
+					}
 					// Check if room is not the main lobby.
-					if client.Room != MAINLOBBY {
-						util.SendClientMessage("leave", client.Room, client, false, props)
-						client.Room = MAINLOBBY
+					if body != MAINLOBBY && client.InRoom(body) {
+						util.SendClientMessage("leave", body, client, false, props)
+						client.LeaveRoom(body, MAINLOBBY)
+					}
+				// User picks which of their rooms to talk in.
+				case "switch", "w":
+					if client.SwitchRoom(body) {
+						util.SendClientReply("switch", client.User, body, client)
+					} else {
+						util.SendClientReply("unrecognized", client.User, body, client)
 					}
 				default:
-					util.SendClientMessage("unrecognized", curAction, client, true, props)
+					util.SendClientReply("unrecognized", client.User, curAction, client)
 				}
 			}
 		}
 	}
 }
 
+// Split a command body into its first word and the rest, like a name and a password.
+func splitArgs(body string) (string, string) {
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.Join(fields[1:], " ")
+}
+
 // Now we parse out the message contents to return individual values.
 func getAction(message string) (string, string) {
 	actionRegex, _ := regexp.Compile(`^\/([^\s]*)\s*(.*)$`)
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Passwords are hashed with PBKDF2-SHA256, slow on purpose so a stolen user
+// file is expensive to guess through.
+const (
+	USERS_FILE          = "users.json"
+	PASSWORD_MIN_LENGTH = 8
+	PASSWORD_ITERATIONS = 600000
+	PASSWORD_SALT_SIZE  = 16
+	PASSWORD_KEY_SIZE   = 32
+)
+
+// Hashing takes a core for a while, so only a few passwords are hashed at
+// once and the rest wait their turn. An address that gets a password wrong
+// waits before its next try, twice as long for every wrong one in a row.
+const (
+	HASH_WORKERS      = 4
+	LOGIN_BACKOFF     = time.Second
+	LOGIN_BACKOFF_MAX = 5 * time.Minute
+)
+
+// A slot for each password being hashed.
+var hashing = make(chan bool, HASH_WORKERS)
+
+// Wrong passwords in a row from one address, and when it can try again.
+type loginFailures struct {
+	count int
+	until time.Time
+}
+
+// What can go wrong registering a name.
+var (
+	ErrRegistered    = errors.New("that name is already registered")
+	ErrShortPassword = errors.New("the password needs at least 8 characters")
+)
+
+// A registered name's salted password hash.
+type Account struct {
+	Salt       string    `json:"salt"`
+	Hash       string    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+// Registered names, kept in a JSON file. Safe to use from several goroutines,
+// the whole file is written again whenever someone registers. ken/server.go
+// keeps its own copy, it's a single file program owned by its lobby thread,
+// so any change to the file format or hashing has to be made in both.
+type UserStore struct {
+	// Where the accounts are saved.
+	path string
+	// Guards accounts, the server handles every client on its own goroutine.
+	mutex    sync.Mutex
+	accounts map[string]*Account
+	// Addresses that got a password wrong, also guarded by the mutex.
+	failures map[string]*loginFailures
+}
+
+// Read the user store, a missing file just means no one has registered yet.
+func LoadUsers(path string) (*UserStore, error) {
+	users := &UserStore{path: path, accounts: make(map[string]*Account), failures: make(map[string]*loginFailures)}
+	data, errNo := ioutil.ReadFile(path)
+	if os.IsNotExist(errNo) {
+		return users, nil
+	}
+	if errNo != nil {
+		return nil, errNo
+	}
+	if errNo = json.Unmarshal(data, &users.accounts); errNo != nil {
+		return nil, errNo
+	}
+	return users, nil
+}
+
+// Check if someone has registered the name.
+func (users *UserStore) Registered(name string) bool {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	return users.accounts[name] != nil
+}
+
+// Register the name with a password. The hashing is slow, so it happens
+// before taking the lock.
+func (users *UserStore) Register(name string, password string) error {
+	if len(password) < PASSWORD_MIN_LENGTH {
+		return ErrShortPassword
+	}
+	if users.Registered(name) {
+		return ErrRegistered
+	}
+	account, errNo := HashPassword(password)
+	if errNo != nil {
+		return errNo
+	}
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	if users.accounts[name] != nil {
+		return ErrRegistered
+	}
+	users.accounts[name] = account
+	return users.save()
+}
+
+// Check the password for a registered name. Unknown names are hashed anyway
+// so they take as long as a wrong password.
+func (users *UserStore) Login(name string, password string) bool {
+	users.mutex.Lock()
+	account := users.accounts[name]
+	users.mutex.Unlock()
+	if account == nil {
+		HashPassword(password)
+		return false
+	}
+	return account.Check(password)
+}
+
+// How long the address has to wait before trying another password.
+func (users *UserStore) Backoff(addr string) time.Duration {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	if failure := users.failures[addr]; failure != nil {
+		if left := time.Until(failure.until); left > 0 {
+			return left
+		}
+	}
+	return 0
+}
+
+// Note a wrong password from the address, doubling how long it has to wait.
+// Addresses that have left it alone for a while are forgotten.
+func (users *UserStore) Failed(addr string) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	now := time.Now()
+	for oAddr, failure := range users.failures {
+		if now.Sub(failure.until) > LOGIN_BACKOFF_MAX {
+			delete(users.failures, oAddr)
+		}
+	}
+	failure := users.failures[addr]
+	if failure == nil {
+		failure = &loginFailures{}
+		users.failures[addr] = failure
+	}
+	backoff := LOGIN_BACKOFF_MAX
+	if failure.count < 20 {
+		backoff = LOGIN_BACKOFF << uint(failure.count)
+		if backoff > LOGIN_BACKOFF_MAX {
+			backoff = LOGIN_BACKOFF_MAX
+		}
+	}
+	failure.count++
+	failure.until = now.Add(backoff)
+}
+
+// A right password clears the address's wrong ones.
+func (users *UserStore) Succeeded(addr string) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	delete(users.failures, addr)
+}
+
+// Write the store to a temporary file and rename it over the old one, so a
+// crash never leaves half a file. Call with the mutex held.
+func (users *UserStore) save() error {
+	data, errNo := json.MarshalIndent(users.accounts, "", "  ")
+	if errNo != nil {
+		return errNo
+	}
+	if errNo = ioutil.WriteFile(users.path+".tmp", data, 0600); errNo != nil {
+		return errNo
+	}
+	return os.Rename(users.path+".tmp", users.path)
+}
+
+// Salt and hash a password into a new account.
+func HashPassword(password string) (*Account, error) {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	if _, errNo := rand.Read(salt); errNo != nil {
+		return nil, errNo
+	}
+	hashing <- true
+	hash, errNo := pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, PASSWORD_KEY_SIZE)
+	<-hashing
+	if errNo != nil {
+		return nil, errNo
+	}
+	return &Account{
+		Salt:       hex.EncodeToString(salt),
+		Hash:       hex.EncodeToString(hash),
+		Iterations: PASSWORD_ITERATIONS,
+		Created:    time.Now(),
+	}, nil
+}
+
+// Check if the password matches the account's hash.
+func (account *Account) Check(password string) bool {
+	salt, errNo := hex.DecodeString(account.Salt)
+	if errNo != nil {
+		return false
+	}
+	hashing <- true
+	hash, errNo := pbkdf2.Key(sha256.New, password, salt, account.Iterations, PASSWORD_KEY_SIZE)
+	<-hashing
+	if errNo != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash)), []byte(account.Hash)) == 1
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"sync"
+)
+
+// Guards the action history, clients and the stream gateway touch it from
+// different goroutines.
+var actionsMutex sync.Mutex
+
+// Closed and replaced every time an action is recorded, so waiting streams
+// can select on it instead of polling.
+var actionsChanged = make(chan struct{})
+
+// Append an action to the history and notify anyone waiting for new ones.
+func recordAction(action Action) {
+	actionsMutex.Lock()
+	defer actionsMutex.Unlock()
+
+	action.Id = len(actions)
+	actions = append(actions, action)
+	close(actionsChanged)
+	actionsChanged = make(chan struct{})
+}
+
+// Return every action in the room from the cursor onwards, the cursor to ask
+// for next time, and a channel that is closed once anything newer is recorded.
+// A cursor past the end (or negative) is clamped, so clients can't skip ahead.
+func ActionsSince(room string, cursor int) ([]Action, int, <-chan struct{}) {
+	actionsMutex.Lock()
+	defer actionsMutex.Unlock()
+
+	if cursor < 0 || cursor > len(actions) {
+		cursor = len(actions)
+	}
+	found := []Action{}
+	for _, action := range actions[cursor:] {
+		if action.Room == room {
+			found = append(found, action)
+		}
+	}
+	return found, len(actions), actionsChanged
+}
+
+// Post a message to a room on behalf of a user that isn't connected over TCP,
+// it's logged and sent to everyone in the room just like a normal message.
+func PostMessage(user string, room string, msg string, ipAddy string) {
+	props := LoadConfig()
+	client := &Client{Room: room, User: user, Prop: props, RemoteAddr: ipAddy}
+	SendClientMessage("message", msg, client, false, props)
+}
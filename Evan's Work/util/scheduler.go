@@ -0,0 +1,155 @@
+package util
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Tells the scheduler what time it is, so expiry can be tested without waiting days.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// The real time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time                         { return time.Now() }
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Runs functions at given times from the owner's own thread, instead of a sleeping
+// goroutine for every room. Entries are kept in a heap ordered by time, and only
+// the earliest one has a timer. Only use it from one goroutine. ken/server.go
+// has its own copy since it's built as a single file, keep the two in step.
+type Scheduler struct {
+	// Where the time comes from.
+	clock Clock
+	// Everything waiting to run, earliest first.
+	entries scheduleHeap
+	// Fires when the earliest entry is due, and what it was set for.
+	wake <-chan time.Time
+	next time.Time
+	// Entries added so far, keeps entries due at the same time in order.
+	count uint64
+}
+
+// Something to run later, it can be cancelled or moved until it has run.
+type ScheduleEntry struct {
+	At    time.Time
+	run   func()
+	seq   uint64
+	index int
+}
+
+type scheduleHeap []*ScheduleEntry
+
+func (entries scheduleHeap) Len() int { return len(entries) }
+
+func (entries scheduleHeap) Less(i, j int) bool {
+	if entries[i].At.Equal(entries[j].At) {
+		return entries[i].seq < entries[j].seq
+	}
+	return entries[i].At.Before(entries[j].At)
+}
+
+func (entries scheduleHeap) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+	entries[i].index = i
+	entries[j].index = j
+}
+
+func (entries *scheduleHeap) Push(x interface{}) {
+	entry := x.(*ScheduleEntry)
+	entry.index = len(*entries)
+	*entries = append(*entries, entry)
+}
+
+func (entries *scheduleHeap) Pop() interface{} {
+	old := *entries
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	// -1 means it has run or been cancelled.
+	entry.index = -1
+	*entries = old[:len(old)-1]
+	return entry
+}
+
+// Make a scheduler that runs on the given clock.
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{clock: clock, entries: make(scheduleHeap, 0)}
+}
+
+// The scheduler's idea of now.
+func (scheduler *Scheduler) Now() time.Time {
+	return scheduler.clock.Now()
+}
+
+// The clock the scheduler runs on.
+func (scheduler *Scheduler) Clock() Clock {
+	return scheduler.clock
+}
+
+// Run fn at the given time.
+func (scheduler *Scheduler) At(at time.Time, fn func()) *ScheduleEntry {
+	scheduler.count++
+	entry := &ScheduleEntry{At: at, run: fn, seq: scheduler.count}
+	heap.Push(&scheduler.entries, entry)
+	scheduler.reset()
+	return entry
+}
+
+// Run fn once d has passed.
+func (scheduler *Scheduler) After(d time.Duration, fn func()) *ScheduleEntry {
+	return scheduler.At(scheduler.Now().Add(d), fn)
+}
+
+// Stop an entry from running, does nothing if it already has.
+func (scheduler *Scheduler) Cancel(entry *ScheduleEntry) {
+	if entry == nil || entry.index < 0 {
+		return
+	}
+	heap.Remove(&scheduler.entries, entry.index)
+	scheduler.reset()
+}
+
+// Move an entry to a new time, putting it back if it already ran.
+func (scheduler *Scheduler) Reschedule(entry *ScheduleEntry, at time.Time) {
+	entry.At = at
+	if entry.index < 0 {
+		scheduler.count++
+		entry.seq = scheduler.count
+		heap.Push(&scheduler.entries, entry)
+	} else {
+		heap.Fix(&scheduler.entries, entry.index)
+	}
+	scheduler.reset()
+}
+
+// Fires when there is something to Run, never if nothing is scheduled.
+func (scheduler *Scheduler) Wake() <-chan time.Time {
+	return scheduler.wake
+}
+
+// Run every entry that is due.
+func (scheduler *Scheduler) Run() {
+	scheduler.next = time.Time{}
+	for len(scheduler.entries) > 0 && !scheduler.entries[0].At.After(scheduler.Now()) {
+		entry := heap.Pop(&scheduler.entries).(*ScheduleEntry)
+		entry.run()
+	}
+	scheduler.reset()
+}
+
+// Point wake at the earliest entry, if that has changed.
+func (scheduler *Scheduler) reset() {
+	if len(scheduler.entries) == 0 {
+		scheduler.wake, scheduler.next = nil, time.Time{}
+		return
+	}
+	at := scheduler.entries[0].At
+	if scheduler.wake != nil && at.Equal(scheduler.next) {
+		return
+	}
+	scheduler.next = at
+	scheduler.wake = scheduler.clock.After(at.Sub(scheduler.Now()))
+}
@@ -0,0 +1,194 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// How long the generated development certificate is good for.
+const DEV_CERT_LIFETIME = 365 * 24 * time.Hour
+
+// How long a client gets to finish the TLS handshake before it's dropped.
+const HANDSHAKE_TIME = 10 * time.Second
+
+// TLS section of config.json, shared by the servers and clients.
+type TLSProperties struct {
+	// Turn TLS on for the chat port.
+	Enabled bool
+	// The server's certificate and key.
+	CertFile string
+	KeyFile  string
+	// The client's certificate and key, only needed for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Generate a self-signed certificate into CertFile/KeyFile if they don't exist.
+	GenerateCert bool
+	// Require a client certificate signed by CAFile, its CN becomes the username.
+	ClientAuth bool
+	// CA used to check the other side, clients can point this at the server's
+	// self-signed certificate.
+	CAFile string
+	// Clients only, skip checking the server certificate. Development only!
+	Insecure bool
+}
+
+// Listen on the address, over TLS if the config asks for it.
+func Listen(network string, address string, props TLSProperties) (net.Listener, error) {
+	listener, errNo := net.Listen(network, address)
+	if errNo != nil || !props.Enabled {
+		return listener, errNo
+	}
+	tlsConfig, errNo := ServerTLSConfig(props)
+	if errNo != nil {
+		listener.Close()
+		return nil, errNo
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Dial the address, over TLS if the config asks for it.
+func Dial(network string, address string, props TLSProperties) (net.Conn, error) {
+	if !props.Enabled {
+		return net.Dial(network, address)
+	}
+	tlsConfig, errNo := ClientTLSConfig(props)
+	if errNo != nil {
+		return nil, errNo
+	}
+	return tls.Dial(network, address, tlsConfig)
+}
+
+// Build the server side config, generating a development certificate first
+// if there isn't one yet.
+func ServerTLSConfig(props TLSProperties) (*tls.Config, error) {
+	if props.GenerateCert && !fileExists(props.CertFile) {
+		errNo := GenerateCert(props.CertFile, props.KeyFile)
+		if errNo != nil {
+			return nil, errNo
+		}
+	}
+	cert, errNo := tls.LoadX509KeyPair(props.CertFile, props.KeyFile)
+	if errNo != nil {
+		return nil, errNo
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if props.ClientAuth {
+		pool, errNo := loadCA(props.CAFile)
+		if errNo != nil {
+			return nil, errNo
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Build the client side config, with the client certificate if there is one.
+func ClientTLSConfig(props TLSProperties) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: props.Insecure}
+	if props.CAFile != "" {
+		pool, errNo := loadCA(props.CAFile)
+		if errNo != nil {
+			return nil, errNo
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if props.ClientCertFile != "" {
+		cert, errNo := tls.LoadX509KeyPair(props.ClientCertFile, props.ClientKeyFile)
+		if errNo != nil {
+			return nil, errNo
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Name from the client certificate (its CN), or "" if the connection isn't
+// TLS or the client didn't send one. Finishes the handshake if needed.
+func PeerName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIME))
+	errNo := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if errNo != nil {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// Write a self-signed certificate for localhost, good enough for development.
+// Clients can trust it by using the certificate as their CAFile.
+// PeerName and GenerateCert are copied in ken/server.go, which builds on its
+// own; keep the two in step.
+func GenerateCert(certFile string, keyFile string) error {
+	key, errNo := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errNo != nil {
+		return errNo
+	}
+	serial, errNo := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if errNo != nil {
+		return errNo
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"GO Chat development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(DEV_CERT_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost", hostname},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, errNo := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if errNo != nil {
+		return errNo
+	}
+	keyDer, errNo := x509.MarshalECPrivateKey(key)
+	if errNo != nil {
+		return errNo
+	}
+	errNo = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if errNo != nil {
+		return errNo
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// Load a PEM bundle of certificates to check the other side against.
+func loadCA(caFile string) (*x509.CertPool, error) {
+	pem, errNo := ioutil.ReadFile(caFile)
+	if errNo != nil {
+		return nil, errNo
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+func fileExists(path string) bool {
+	_, errNo := os.Stat(path)
+	return errNo == nil
+}
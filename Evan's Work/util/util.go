@@ -1,11 +1,13 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,16 +25,22 @@ var DECODE_ENCODED_TOKEN = []string{"%3A", "%5B", "%5D", "%2C", "%22", "%25"}
 type Client struct {
 	// Client connection.
 	UserConnection net.Conn
-	// Client's room, or a global room.
+	// Client's room, or a global room. This is the room their messages go to.
 	Room string
+	// Every room the client has entered, they hear messages from all of them.
+	Rooms []string
 	// Config file of properties.
 	Prop Properties
 	// Clients username
 	User string
+	// Address used for logging when there is no connection (HTTP gateway posts).
+	RemoteAddr string
 }
 
 // Structure for logging files.
 type Action struct {
+	// Position in the action history, used as a cursor by the stream gateway.
+	Id int
 	// The commands that were previously stated.
 	Comm string
 	// Action specific, such as leaving and entering a room
@@ -64,13 +72,22 @@ type Properties struct {
 
 	// Location for the JSON log file.
 	LogFile string
+
+	// Port for the live room stream gateway (Server-Sent Events and long polling).
+	StreamEndpointPort string
+
+	// TLS settings, read from the "TLS" section of config.json.
+	TLS TLSProperties
 }
 
 // an array of actions for storage purposes to read back to user or store to log.
 var actions = []Action{}
 
-// Static client list
+// Static client list. Every connection and the stream gateway use it from their
+// own goroutines, so it's only touched with clientsMutex held. The lock also
+// covers each client's name and rooms, which others read to route messages.
 var curClients []*Client
+var clientsMutex sync.Mutex
 
 // Cached version of the config file for the server.
 var config = Properties{}
@@ -81,16 +98,86 @@ var config = Properties{}
 // Register the connection upon connecting and cache them.
 func (client *Client) Register() {
 	// fmt.Println("Adding user to list")
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
 	curClients = append(curClients, client)
 }
 
+// Set the client's name, under the lock since others look clients up by it.
+func (client *Client) SetUser(name string) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	client.User = name
+}
+
+// Enter a room without leaving the others, it becomes the room the client talks in.
+func (client *Client) Enter(room string) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if !client.InRoom(room) {
+		client.Rooms = append(client.Rooms, room)
+	}
+	client.Room = room
+}
+
+// Leave one of the client's rooms. If it was the one they talk in, they switch to the
+// last room they entered, or to the fallback if there are none left.
+func (client *Client) LeaveRoom(room string, fallback string) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for i, curRoom := range client.Rooms {
+		if curRoom == room {
+			client.Rooms = append(client.Rooms[:i], client.Rooms[i+1:]...)
+			if client.Room == room {
+				client.Room = fallback
+				if len(client.Rooms) > 0 {
+					client.Room = client.Rooms[len(client.Rooms)-1]
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Switch which of the client's rooms their messages go to.
+func (client *Client) SwitchRoom(room string) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if !client.InRoom(room) {
+		return false
+	}
+	client.Room = room
+	return true
+}
+
+// Check if the client hears messages from the room.
+func (client *Client) InRoom(room string) bool {
+	if client.Room == room {
+		return true
+	}
+	for _, curRoom := range client.Rooms {
+		if curRoom == room {
+			return true
+		}
+	}
+	return false
+}
+
 // Client closing a connection, by either exiting or just closing the window.
 func (client *Client) Close(sendMessage bool) {
 	if sendMessage {
-		SendClientMessage("disconnected", "", client, false, client.Prop)
+		// this runs on the reader goroutine, while the client's input is still
+		// being handled on another, so say goodbye from a copy taken under the lock
+		clientsMutex.Lock()
+		leaving := *client
+		clientsMutex.Unlock()
+		SendClientMessage("disconnected", "", &leaving, false, client.Prop)
 	}
 	// Close the connection to client and remove from user list.
 	client.UserConnection.Close()
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
 	curClients = removeEntry(client, curClients)
 }
 
@@ -142,29 +229,66 @@ func SendClientMessage(messageType string, message string, client *Client, thisC
 
 		// construct the payload to be sent to clients
 		pLoad := fmt.Sprintf("/%v [%v] %v", messageType, client.User, message)
+		if messageType == "message" {
+			// clients can be in several rooms, so say which one it came from
+			pLoad = fmt.Sprintf("/%v [%v] {%v} %v", messageType, client.User, client.Room, message)
+		}
 
-		for _, _client := range curClients {
-			// write the message to the client
-			if (thisClientOnly && _client.User == client.User) ||
-				(!thisClientOnly && _client.User != "") {
+		// write the message to the clients, outside the lock so a slow
+		// connection doesn't hold everyone else up
+		for _, connection := range listeners(client.Room, messageType == "message") {
+			fmt.Fprintln(connection, pLoad)
+		}
+	}
+}
 
-				// you should only see a message if you are in the same room
-				if messageType == "message" && client.Room != _client.Room {
-					continue
-				}
+// Send a reply to just this client, in the same "/type [user] body" form as
+// everything else so the client can read the name back out.
+func SendClientReply(messageType string, user string, message string, client *Client) {
+	fmt.Fprintln(client.UserConnection, fmt.Sprintf("/%v [%v] %v", messageType, user, message))
+}
 
-				// you won't hear any activity if you are anonymous unless thisClientOnly
-				// when current client will *only* be messaged
-				fmt.Fprintln(_client.UserConnection, pLoad)
-			}
+// The connections of everyone who should hear a message. You won't hear any
+// activity if you are anonymous, and you should only see a chat message if
+// you are in that room.
+func listeners(room string, roomOnly bool) []net.Conn {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	connections := []net.Conn{}
+	for _, client := range curClients {
+		if client.User != "" && (!roomOnly || client.InRoom(room)) {
+			connections = append(connections, client.UserConnection)
+		}
+	}
+	return connections
+}
+
+// Find the connected client using the name.
+func FindUser(name string) *Client {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for _, client := range curClients {
+		if client.User == name {
+			return client
 		}
 	}
+	return nil
 }
 
 // END USEREND STUFF
 
 //BEGIN MISC
 
+// The host part of an address, what login backoff is kept by, so a new
+// port doesn't get a new set of tries.
+func HostOf(addr string) string {
+	host, _, errNo := net.SplitHostPort(addr)
+	if errNo != nil {
+		return addr
+	}
+	return host
+}
+
 // Simple error checker to see if messages are empty.
 func CheckForError(errNo error, msg string) {
 	if errNo != nil {
@@ -198,11 +322,14 @@ func replace(tokenReplacers []string, toTokens []string, val string) string {
 
 func LogAction(act string, msg string, client *Client, property Properties) {
 	// Get the IP and timestamp for it to be logged.
-	ipAddy := client.UserConnection.RemoteAddr().String()
+	ipAddy := client.RemoteAddr
+	if client.UserConnection != nil {
+		ipAddy = client.UserConnection.RemoteAddr().String()
+	}
 	stampOfTime := time.Now().Format(TIME_LAYOUT)
 
-	// Keep track of all actions in the action array.
-	actions = append(actions, Action{
+	// Keep track of all actions in the action array, and wake up anyone streaming them.
+	recordAction(Action{
 		Comm:     act,
 		Content:  msg,
 		Username: client.User,
@@ -278,7 +405,24 @@ func LoadConfig() Properties {
 		HasLeftLobbyMsg:    "[%s] has left the lobby",
 		ReceivedMsg:        "{%s} says: %s",
 		LogFile:            "./log.txt",
+		StreamEndpointPort: "8081",
 	}
+	rturnVals.TLS = LoadTLSConfig()
 	config = rturnVals
 	return rturnVals
 }
+
+// Only the TLS section of config.json is read for now, everything else is
+// still the defaults above. Without a config file TLS stays off.
+func LoadTLSConfig() TLSProperties {
+	var confData struct {
+		TLS TLSProperties
+	}
+	confFile, errNo := ioutil.ReadFile("config.json")
+	if errNo != nil {
+		return confData.TLS
+	}
+	errNo = json.Unmarshal(confFile, &confData)
+	CheckForError(errNo, "Invalid JSON in config.json.")
+	return confData.TLS
+}
@@ -6,17 +6,80 @@ import (
 	"fmt"
 	"os"
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
 )
 
 const (
+	CONN_HOST = "localhost"
 	CONN_PORT = ":1234"
 	CONN_TYPE = "tcp"
 
+	CONFIG_FILE = "config.json"
+
 	MSG_DISCONNECT = "Disconnected.\n"
 )
 
 var wg sync.WaitGroup
 
+// the parts of config.json the client cares about
+type Config struct {
+	TLS struct {
+		Enabled bool
+	}
+	Client struct {
+		CAFile     string // trusted server certificate, e.g. the generated cert.pem
+		CertFile   string // client certificate for mutual tls
+		KeyFile    string
+		Insecure   bool   // skip checking the server certificate
+		Host       string // server to connect to, localhost if empty
+		ServerName string // name the server certificate must carry, the host if empty
+	}
+}
+
+// connects to the server, over tls if config.json turns it on
+func Dial() (net.Conn, error) {
+	var config Config
+	data, err := ioutil.ReadFile(CONFIG_FILE)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	host := config.Client.Host
+	if host == "" {
+		host = CONN_HOST
+	}
+	if !config.TLS.Enabled {
+		return net.Dial(CONN_TYPE, host+CONN_PORT)
+	}
+
+	serverName := config.Client.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	tlsConfig := &tls.Config{ServerName: serverName, InsecureSkipVerify: config.Client.Insecure}
+	if config.Client.CAFile != "" {
+		data, err := ioutil.ReadFile(config.Client.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(data)
+	}
+	if config.Client.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.Client.CertFile, config.Client.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tls.Dial(CONN_TYPE, host+CONN_PORT, tlsConfig)
+}
+
 // Reads from the socket and outputs to the console.
 func Read(conn net.Conn) {
 	reader := bufio.NewReader(conn)
@@ -60,9 +123,10 @@ func Write(conn net.Conn) {
 func main() {
 	wg.Add(1)
 
-	conn, err := net.Dial(CONN_TYPE, CONN_PORT)
+	conn, err := Dial()
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	go Read(conn)
@@ -4,47 +4,338 @@ import (
 	"os"    // operating system functionality package
 	"log"   // logging pkg
 	"strings"
+	"strconv"
+	"sort"
+	"unicode/utf8"
+	"container/heap"
 	"bufio" // buffered io
 	"net"   // client/server pkg
 	"fmt"   // formatted io
 	"time"
+	"sync"
+	"sync/atomic"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"math/big"
+	"net/http"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/pbkdf2"
+	"crypto/subtle"
+	"encoding/hex"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"code.google.com/p/go.net/websocket" // vendored under Evan's Work/Assign4/src
 )
 
 const (
 	CONN_PORT = ":1234"
 	CONN_TYPE = "tcp"
+	WS_PORT   = ":1235"
+	WS_PATH   = "/chat"
+	IRC_PORT  = ":6667"
+	TELNET_PORT = ":2323" // like CONN_PORT, but the server starts telnet negotiation
+
+	CONFIG_FILE       = "config.json"
+	JOURNAL_FILE      = "rooms.journal" // used when config.json doesnt name one
+	USERS_FILE        = "users.json"    // registered names and their password hashes
+	EXPIRY_WARNING    = "1h"            // how long before archiving occupants are warned
+	RESUME_GRACE      = "5m"            // how long a dropped client's name and rooms are held
+	ANNOUNCEMENTS     = "announcements" // read-only room everyone joins on connect
+	DEV_CERT_LIFETIME = 365 * 24 * time.Hour
+	HANDSHAKE_TIME    = 10 * time.Second // a client that stalls the tls handshake longer is dropped
 
 	MAX_CLIENTS = 10
 
+	IDLE_TIME   = 10 * time.Minute // without sending anything, after which a client shows as idle
+
+	// hashing a password takes a core for a while, so only a few run at once
+	// and an address that keeps getting it wrong waits longer each time
+	HASH_WORKERS      = 4
+	LOGIN_BACKOFF     = time.Second // after the first failure, doubled for each one after
+	LOGIN_BACKOFF_MAX = 5 * time.Minute
+	AWAY_REASON = "no reason given" // when /away is given none
+
+	// backlog kept per room, config.json can change these
+	HISTORY_MAX_MESSAGES = 1000
+	HISTORY_MAX_BYTES    = 256 * 1024
+	HISTORY_REPLAY       = 20 // lines sent on join and per /history page
+
 	CMD_PFX = "/"
 	CMD_CREATE = CMD_PFX + "c"
 	CMD_LIST   = CMD_PFX + "l"
 	CMD_JOIN   = CMD_PFX + "j"
 	CMD_LEAVE  = CMD_PFX + "leave"
+	CMD_SWITCH = CMD_PFX + "switch"
+	CMD_W      = CMD_PFX + "w" // short for CMD_SWITCH
 	CMD_HELP   = CMD_PFX + "h"
 	CMD_NAME   = CMD_PFX + "n"
 	CMD_QUIT   = CMD_PFX + "q"
+	CMD_PROTO  = CMD_PFX + "proto"
+	CMD_HISTORY = CMD_PFX + "history"
+	CMD_INVITE  = CMD_PFX + "invite"
+	CMD_OP      = CMD_PFX + "op"
+	CMD_KICK    = CMD_PFX + "kick"
+	CMD_BAN     = CMD_PFX + "ban"
+	CMD_UNBAN   = CMD_PFX + "unban"
+	CMD_MUTE    = CMD_PFX + "mute"
+	CMD_TOPIC   = CMD_PFX + "topic"
+	CMD_ARCHIVES = CMD_PFX + "archives"
+	CMD_RESTORE = CMD_PFX + "restore"
+	CMD_READONLY = CMD_PFX + "readonly"
+	CMD_REGISTER = CMD_PFX + "register"
+	CMD_LOGIN    = CMD_PFX + "login"
+	CMD_RESUME   = CMD_PFX + "resume"
+	CMD_AWAY     = CMD_PFX + "away"
+	CMD_BACK     = CMD_PFX + "back"
+	CMD_MSG      = CMD_PFX + "msg"
+	CMD_STATUS   = CMD_PFX + "status"
+	CMD_WHO      = CMD_PFX + "who"
+	CMD_WHOIS    = CMD_PFX + "whois"
+	CMD_YES     = CMD_PFX + "y" // joins the room suggested by the last failed /j
 
-	CLIENT_NAME = "new_user" // TODO should implement new_user1, new_user2, etc
+	CLIENT_NAME = "new_user" // guests are new_user1, new_user2, etc
 	SERVER_NAME = "Server"
 
 	ERROR_PFX 		= "Error: "
 	ERROR_SEND   	= ERROR_PFX + "You cannot send messages in the lobby.\n"
 	ERROR_CREATE	= ERROR_PFX + "A chat room with that name already exists.\n"
 	ERROR_JOIN   	= ERROR_PFX + "A chat room with that name does not exist.\n"
+	ERROR_SUGGEST	= ERROR_PFX + "A chat room with that name does not exist. Did you mean %s? Type \"" + CMD_YES + "\" to join \"%s\".\n"
+	ERROR_ARCHIVED	= ERROR_PFX + "A chat room with that name is archived, try \"" + CMD_RESTORE + " %s\".\n"
+	ERROR_RESTORE	= ERROR_PFX + "There is no archived chat room with that name, \"" + CMD_ARCHIVES + "\" lists them.\n"
+	ERROR_RESTORE_OWNER	= ERROR_PFX + "Only the creator of \"%s\" can restore it.\n"
+	ERROR_LIST_PATTERN	= ERROR_PFX + "\"%s\" is not a valid pattern, try something like \"dev-*\".\n"
+	ERROR_NOT_IN	= ERROR_PFX + "You are not in \"%s\".\n"
+	ERROR_NO_SUGGESTION	= ERROR_PFX + "There is no suggested chat room to join.\n"
 	ERROR_LEAVE  	= ERROR_PFX + "You cannot leave the lobby.\n"
+	ERROR_PROTO  	= ERROR_PFX + "Unsupported protocol, try \"" + CMD_PROTO + " json 1\" or \"" + CMD_PROTO + " plain\".\n"
+	ERROR_FRAME  	= ERROR_PFX + "Malformed frame.\n"
+	ERROR_CERT_NAME	= ERROR_PFX + "Your name comes from your certificate.\n"
+	ERROR_CERT_TAKEN	= ERROR_PFX + "\"%s\" from your certificate is registered or already connected.\n"
+	ERROR_ROOM_NAME	= ERROR_PFX + "A chat room needs a name, try \"" + CMD_CREATE + " name [password]\".\n"
+	ERROR_PASSWORD	= ERROR_PFX + "Wrong password, try \"" + CMD_JOIN + " name password\".\n"
+	ERROR_INVITE_ONLY	= ERROR_PFX + "That chat room is invite-only.\n"
+	ERROR_INVITE	= ERROR_PFX + "Only the creator of a chat room can invite people to it.\n"
+	ERROR_PRIVATE	= ERROR_PFX + "Only registered names can own private chat rooms, so they are still yours after you reconnect. Type \"" + CMD_REGISTER + " name password\" first.\n"
+	ERROR_NICK		= ERROR_PFX + "No one is called \"%s\".\n"
+	ERROR_OWNER		= ERROR_PFX + "Only the creator of a chat room can make moderators.\n"
+	ERROR_MODERATOR	= ERROR_PFX + "Only moderators can do that.\n"
+	ERROR_NOT_MEMBER	= ERROR_PFX + "\"%s\" is not in this chat room.\n"
+	ERROR_PROTECTED	= ERROR_PFX + "You cannot do that to the creator or a moderator.\n"
+	ERROR_BANNED	= ERROR_PFX + "You are banned from that chat room.\n"
+	ERROR_NOT_BANNED	= ERROR_PFX + "\"%s\" is not banned.\n"
+	ERROR_MUTE		= ERROR_PFX + "Try \"" + CMD_MUTE + " name 10m\".\n"
+	ERROR_TOPIC		= ERROR_PFX + "Only moderators can change the topic.\n"
+	ERROR_NAME      	= ERROR_PFX + "Type \"" + CMD_NAME + " name\", names cannot have spaces.\n"
+	ERROR_REGISTERED	= ERROR_PFX + "\"%s\" is registered, type \"" + CMD_LOGIN + " %s password\" if it is yours.\n"
+	ERROR_NAME_IN_USE	= ERROR_PFX + "Someone else is using \"%s\".\n"
+	ERROR_REGISTER  	= ERROR_PFX + "Type \"" + CMD_REGISTER + " name password\", the password needs at least 8 characters.\n"
+	ERROR_LOGIN     	= ERROR_PFX + "Wrong name or password.\n"
+	ERROR_LOGIN_BUSY	= ERROR_PFX + "Still checking your last password, wait for the answer.\n"
+	ERROR_LOGIN_WAIT	= ERROR_PFX + "Too many wrong passwords, try again in %s.\n"
+	ERROR_RESUME    	= ERROR_PFX + "That resume token is unknown or has expired.\n"
+	ERROR_MSG       	= ERROR_PFX + "Type \"" + CMD_MSG + " name message\".\n"
+	ERROR_NOT_AWAY  	= ERROR_PFX + "You are not away.\n"
+	ERROR_WHOIS     	= ERROR_PFX + "Type \"" + CMD_WHOIS + " name\".\n"
+	ERROR_READ_ONLY	= ERROR_PFX + "\"%s\" is read-only, only its moderators can post. Type \"" + CMD_SWITCH + " name\" to talk in another chat room.\n"
+	ERROR_MUTED		= ERROR_PFX + "You are muted for another %s.\n"
+	ERROR_HISTORY	= ERROR_PFX + "You are not in a chat room, try \"" + CMD_HISTORY + " [before-id] [n]\" after joining one.\n"
 
 	NOTICE_PFX          	= "Notice: "
 	NOTICE_ROOM_JOIN       	= NOTICE_PFX + "\"%s\" joined.\n"
 	NOTICE_ROOM_LEAVE      	= NOTICE_PFX + "\"%s\" left.\n"
 	NOTICE_ROOM_NAME       	= NOTICE_PFX + "\"%s\" is now \"%s\".\n"
-	NOTICE_ROOM_DELETE     	= NOTICE_PFX + "Inactive Room, Deleting...\n"
+	NOTICE_ROOM_DELETE     	= NOTICE_PFX + "Inactive Room, archiving it. \"" + CMD_RESTORE + " %s\" brings it back.\n"
+	NOTICE_REGISTERED      	= NOTICE_PFX + "Registered \"%s\", type \"" + CMD_LOGIN + " %s password\" to use it next time.\n"
+	NOTICE_LOGGED_IN       	= NOTICE_PFX + "Logged in as \"%s\".\n"
+	NOTICE_TOKEN           	= NOTICE_PFX + "If you lose your connection, reconnect within %s and type \"" + CMD_RESUME + " %s\" to carry on.\n"
+	NOTICE_RESUMED         	= NOTICE_PFX + "Welcome back, \"%s\".\n"
+	NOTICE_ROOM_BACK       	= NOTICE_PFX + "\"%s\" is back.\n"
+	NOTICE_AWAY            	= NOTICE_PFX + "You are away (%s), type \"" + CMD_BACK + "\" when you return.\n"
+	NOTICE_BACK            	= NOTICE_PFX + "You are no longer away.\n"
+	NOTICE_AWAY_REPLY      	= NOTICE_PFX + "\"%s\" is away: %s\n"
+	NOTICE_STATUS          	= NOTICE_PFX + "\"%s\" is %s, idle for %s.\n"
+	NOTICE_RENAMED         	= NOTICE_PFX + "\"%s\" logged in with their registered name.\n"
+	NOTICE_CERT_RENAMED    	= NOTICE_PFX + "\"%s\" connected with a certificate for that name.\n"
+	NOTICE_ROOM_READ_ONLY  	= NOTICE_PFX + "\"%s\" made the room read-only, only moderators can post.\n"
+	NOTICE_ROOM_WRITABLE   	= NOTICE_PFX + "\"%s\" let everyone post in the room again.\n"
+	NOTICE_ROOM_EXPIRING   	= NOTICE_PFX + "This room will be archived in %s unless someone talks.\n"
+	NOTICE_LOBBY_RESTORE   	= NOTICE_PFX + "Restored \"%s\" with its history, type \"" + CMD_JOIN + " %s\" to join.\n"
 	NOTICE_LOBBY_CREATE 	= NOTICE_PFX + "Created \"%s\".\n"
+	NOTICE_LOBBY_PRIVATE 	= NOTICE_PFX + "Created \"%s\", people need the password to join.\n"
+	NOTICE_ROOM_INVITE  	= NOTICE_PFX + "Invited \"%s\", \"%s\" is invite-only.\n"
+	NOTICE_INVITED      	= NOTICE_PFX + "\"%s\" invited you to \"%s\", type \"" + CMD_JOIN + " %s\" to join.\n"
+	NOTICE_ROOM_OP      	= NOTICE_PFX + "\"%s\" is now a moderator.\n"
+	NOTICE_ROOM_KICK    	= NOTICE_PFX + "\"%s\" was kicked by \"%s\".\n"
+	NOTICE_ROOM_BAN     	= NOTICE_PFX + "\"%s\" was banned by \"%s\".\n"
+	NOTICE_ROOM_UNBAN   	= NOTICE_PFX + "\"%s\" was unbanned by \"%s\".\n"
+	NOTICE_ROOM_MUTE    	= NOTICE_PFX + "\"%s\" was muted for %s by \"%s\".\n"
+	NOTICE_ROOM_UNMUTE  	= NOTICE_PFX + "\"%s\" can talk again.\n"
+	NOTICE_ROOM_TOPIC   	= NOTICE_PFX + "\"%s\" changed the topic to \"%s\".\n"
+	NOTICE_TOPIC        	= NOTICE_PFX + "Topic: %s\n"
+	NOTICE_DESCRIPTION  	= NOTICE_PFX + "About: %s\n"
+	NOTICE_NO_TOPIC     	= NOTICE_PFX + "No topic is set.\n"
+	NOTICE_SWITCH       	= NOTICE_PFX + "Now talking in \"%s\".\n"
+	NOTICE_ROOMS        	= NOTICE_PFX + "You are in %s, talking in \"%s\".\n"
+	NOTICE_ROOMS_IDLE   	= NOTICE_PFX + "You are in %s, type \"" + CMD_SWITCH + " name\" to talk in one.\n"
+	NOTICE_NO_ROOMS     	= NOTICE_PFX + "You are not in any chat rooms.\n"
+	NOTICE_KICKED       	= NOTICE_PFX + "You were removed from \"%s\".\n"
+	NOTICE_HISTORY_MORE 	= NOTICE_PFX + "%d earlier messages, \"" + CMD_HISTORY + "\" shows more.\n"
+	NOTICE_HISTORY_END  	= NOTICE_PFX + "No earlier messages.\n"
 
 	MSG_CONNECT = "Welcome. Type \"/h\" for commands.\n"
 	MSG_FULL    = "Server is full."
 
 	EXPIRY_TIME time.Duration = 7 * 24 * time.Hour
+
+	// archived rooms are dropped for good after a while, or sooner, oldest
+	// first, once there are more than MAX_ARCHIVES of them
+	ARCHIVE_TIME time.Duration = 30 * 24 * time.Hour
+	MAX_ARCHIVES               = 100
+
+	// framed protocol, negotiated with "/proto json 1"
+	PROTO_NAME_PLAIN = "plain"
+	PROTO_NAME_JSON  = "json"
+	PROTO_VERSION    = 1
+
+	FRAME_MSG    = "msg"    // chat line from a user
+	FRAME_CMD    = "cmd"    // command sent by a framed client
+	FRAME_NOTICE = "notice" // server notice (NOTICE_*)
+	FRAME_ERROR  = "error"  // server error (ERROR_*)
+	FRAME_INFO   = "info"   // listings and help text
+	FRAME_HELLO  = "hello"  // protocol negotiation reply
+	FRAME_RAW    = "raw"    // preformatted protocol line, only sent to irc clients
+
+	// journal operations, one JSON entry per line
+	JOURNAL_CREATE  = "create"
+	JOURNAL_MESSAGE = "msg"
+	JOURNAL_DELETE  = "delete" // an archived room dropped for good, or a room in a journal from before archiving
+	JOURNAL_ARCHIVE = "archive"
+	JOURNAL_RESTORE = "restore"
+	JOURNAL_INVITE  = "invite-only" // room stopped letting in people without an invite
+	JOURNAL_BAN     = "ban"
+	JOURNAL_UNBAN   = "unban"
+	JOURNAL_TOPIC   = "topic"
+	JOURNAL_READONLY = "read-only" // only moderators can post, or everyone again
+	JOURNAL_MEMBER  = "member"      // a registered name was let into the room
+	JOURNAL_OWNER   = "owner"       // the room passed to a registered name
+	JOURNAL_OP      = "moderator"   // a registered name was made a moderator
+	JOURNAL_MUTE    = "mute"        // a registered name was muted until a time
+
+	BAN_HOST = "host" // "/ban name host" bans the address they are on as well
+
+	// /l sort orders, and how it shows when a room was last used
+	LIST_SORT_NAME   = "name"
+	LIST_SORT_ACTIVE = "active"
+	LIST_SORT_SIZE   = "size"
+	LIST_TIME_FORMAT = "Jan 2 15:04"
+
+	SECRET_SALT_SIZE = 16
+
+	// account passwords are hashed with PBKDF2-SHA256, slow on purpose
+	PASSWORD_MIN_LENGTH = 8
+	PASSWORD_ITERATIONS = 600000
+	PASSWORD_KEY_SIZE   = 32
+
+	TOKEN_SIZE = 32 // random bytes in a resume token, sent as hex
+
+	MAX_SUGGESTIONS = 3
+	TYPO_LETTERS    = 4 // a suggestion can be one edit off per this many letters typed, rounded
+
+	// what /status shows, away comes with the reason
+	STATUS_ONLINE = "online"
+	STATUS_IDLE   = "idle"
+	STATUS_AWAY   = "away (%s)"
+
+	// IRC numerics and names, RFC 1459/2812
+	IRC_SERVER            = "ken"
+	IRC_WELCOME           = "001"
+	IRC_YOURHOST          = "002"
+	IRC_CREATED           = "003"
+	IRC_MYINFO            = "004"
+	IRC_AWAY              = "301"
+	IRC_UNAWAY            = "305"
+	IRC_NOWAWAY           = "306"
+	IRC_WHOISUSER         = "311"
+	IRC_WHOISSERVER       = "312"
+	IRC_ENDOFWHO          = "315"
+	IRC_WHOISIDLE         = "317"
+	IRC_ENDOFWHOIS        = "318"
+	IRC_WHOISCHANNELS     = "319"
+	IRC_WHOREPLY          = "352"
+	IRC_WHOISHOST         = "378"
+	IRC_LISTSTART         = "321"
+	IRC_LIST              = "322"
+	IRC_LISTEND           = "323"
+	IRC_CHANNELMODEIS     = "324"
+	IRC_NOTOPIC           = "331"
+	IRC_TOPIC             = "332"
+	IRC_NAMREPLY          = "353"
+	IRC_ENDOFNAMES        = "366"
+	IRC_NOSUCHNICK        = "401"
+	IRC_INVITING          = "341"
+	IRC_NOSUCHCHANNEL     = "403"
+	IRC_CANNOTSENDTOCHAN  = "404"
+	IRC_UNKNOWNCOMMAND    = "421"
+	IRC_NOMOTD            = "422"
+	IRC_NONICKNAMEGIVEN   = "431"
+	IRC_ERRONEUSNICKNAME  = "432"
+	IRC_NICKNAMEINUSE     = "433"
+	IRC_NOTONCHANNEL      = "442"
+	IRC_NOTREGISTERED     = "451"
+	IRC_NEEDMOREPARAMS    = "461"
+	IRC_INVITEONLYCHAN    = "473"
+	IRC_BANNEDFROMCHAN    = "474"
+	IRC_BADCHANNELKEY     = "475"
+	IRC_CHANOPRIVSNEEDED  = "482"
+)
+
+// wire protocols a client can speak
+const (
+	PROTO_PLAIN = iota
+	PROTO_JSON
+	PROTO_IRC
+)
+
+// how much telnet a listener speaks. passive connections only answer
+// negotiation the client starts, active ones offer echo, SGA and NAWS
+const (
+	TELNET_OFF = iota
+	TELNET_PASSIVE
+	TELNET_ACTIVE
+)
+
+// telnet commands and options, RFC 854/857/858/1073
+const (
+	TELNET_SE   byte = 240
+	TELNET_EC   byte = 247 // erase character
+	TELNET_EL   byte = 248 // erase line
+	TELNET_SB   byte = 250
+	TELNET_WILL byte = 251
+	TELNET_WONT byte = 252
+	TELNET_DO   byte = 253
+	TELNET_DONT byte = 254
+	TELNET_IAC  byte = 255
+
+	TELNET_ECHO byte = 1
+	TELNET_SGA  byte = 3
+	TELNET_NAWS byte = 31
+)
+
+// where the telnet input parser is between bytes
+const (
+	TELNET_STATE_DATA = iota
+	TELNET_STATE_IAC
+	TELNET_STATE_OPTION
+	TELNET_STATE_SB
+	TELNET_STATE_SB_IAC
 )
 
 
@@ -54,52 +345,478 @@ const (
 type Lobby struct {
 	clients   []*Client
 	chatRooms map[string]*ChatRoom
+	journal   *Journal
+	history   *HistoryConfig
 	incoming  chan *Message
 	join      chan *Client
 	leave     chan *Client
-	delete    chan *ChatRoom
+	scheduler *Scheduler // timed work, run on the lobby thread
+	archives  map[string]*ChatRoom // expired rooms, kept with their history
+	warning   time.Duration        // how long before archiving a room says so
+
+	announcements *ChatRoom // joined on connect, nil for the old welcome notice
+
+	users  *UserStore
+	logins chan *Login // passwords checked off the lobby thread
+	hashing chan bool  // a slot per password being hashed, HASH_WORKERS of them
+	failedLogins map[string]*LoginFailures // by host
+	guests int         // last guest number handed out
+
+	sessions    map[string]*Session // dropped clients waiting to resume, by token
+	resumeGrace time.Duration       // how long they wait
+}
+
+/* what a client that dropped had, held for the grace period so they can
+ * reconnect and /resume it. nobody else can take the name meanwhile, so
+ * the rooms they own, moderate or were let into stay theirs by name, and
+ * so do their mutes */
+type Session struct {
+	name      string
+	account   string
+	chatRooms []*ChatRoom // rooms they were in, oldest first
+	chatRoom  *ChatRoom   // the one they were talking in
+	away      string
+	lastId    uint64         // newest frame before they went, later ones are replayed
+	expire    *ScheduleEntry // forgets the session
+}
+
+/* registered names, kept in a JSON file. only used from the lobby thread,
+ * saved whole whenever an account is added. Evan's Work/util/accounts.go
+ * has the same store for server.go and newServer.go, but ken is one file
+ * built on its own, and that copy locks for its thread per client. the
+ * file format and hashing are the same, keep them that way so a users.json
+ * works with either */
+type UserStore struct {
+	path     string
+	accounts map[string]*Account
+}
+
+// a registered name's salted password hash
+type Account struct {
+	Salt       string    `json:"salt"` // hex
+	Hash       string    `json:"hash"` // hex PBKDF2-SHA256
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+/* wrong passwords from one address. it cant try again until the backoff
+ * is over, and it is forgotten once it has left it alone for a while */
+type LoginFailures struct {
+	count  int
+	until  time.Time
+	forget *ScheduleEntry
+}
+
+/* a /register or /login on its way back to the lobby thread, after the slow
+ * hashing has been done on another */
+type Login struct {
+	client   *Client
+	name     string
+	register bool
+	account  *Account // the new account, for /register
+	ok       bool     // whether the password matched, for /login or a room
+	room     string   // a private room being created, or joined with its password
+	secret   string   // hash of the new room's password, when creating one
 }
 
 // Name of the chatroom, current clients, messagse, and expiry date and time. 
 type ChatRoom struct {
 	name     string
 	clients  []*Client
-	messages []string
+	messages []*Frame
+	bytes    int // payload bytes in messages
 	expiry   time.Time
+	journal  *Journal
+	history  *HistoryConfig
+	clock    Clock
+	expire   *ScheduleEntry // checks expiry, rescheduled while the room is in use
+	warn     *ScheduleEntry // warns occupants before it expires
+	archived time.Time      // when it was archived, zero while it is open
+	purge    *ScheduleEntry // drops it for good once it has been archived ARCHIVE_TIME
+
+	// private rooms, hidden from /l for anyone who isnt a member
+	owner      string          // identity of the creator, the only one who can /invite and /op
+	secret     string          // salted hash of the password, empty for none
+	inviteOnly bool
+	members    map[string]bool // identities let in, by invite or password
+
+	moderators map[string]bool           // identities, like members
+	bans       map[string]string         // banned names to the host they were on if that was banned too, kept while the room lives
+	muted      map[string]*ScheduleEntry // identities to what unmutes them
+
+	topic       string // one line, shown in /l
+	description string // longer, shown on join
+
+	readOnly bool // only moderators post, and comings and goings arent announced
+
+	announcers *AnnouncementsConfig // who moderates the announcements room, nil for the rest
+}
+
+/* Append-only log of everything that changes rooms, so rooms and their
+ * history survive restarts and crashes. Rewritten from the live rooms on
+ * startup so it doesnt grow forever. Appended to from the lobby thread,
+ * its own goroutine syncs it to disk */
+type Journal struct {
+	path  string
+	file  *os.File
+	dirty chan bool // holds a wakeup while there are writes waiting for a sync
+	done  chan bool // closed once the syncing goroutine has finished
+}
+
+// one line of the journal
+type JournalEntry struct {
+	Op    string    `json:"op"`
+	Room  string    `json:"room"`
+	Time  time.Time `json:"ts"` // rooms expire EXPIRY_TIME after their last entry
+	Frame *Frame    `json:"frame,omitempty"`
+
+	Secret     string `json:"secret,omitempty"` // password hash, never the password
+	Owner      string `json:"owner,omitempty"`  // registered name of the creator
+	Until      *time.Time `json:"until,omitempty"` // when a mute ends
+	InviteOnly bool   `json:"inviteOnly,omitempty"`
+	ReadOnly   bool   `json:"readOnly,omitempty"`
+	Name       string `json:"name,omitempty"` // banned name
+	Host       string `json:"host,omitempty"` // and where they connected from
+
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
 // contains the clients name, current room, and connection info 
 type Client struct {
 	name     string
-	chatRoom *ChatRoom
+	chatRoom *ChatRoom   // active room, where plain text goes
+	chatRooms []*ChatRoom // every room the client is in
 	incoming chan *Message
-	outgoing chan string
+	outgoing chan *Frame
 	conn     net.Conn
 	reader   *bufio.Reader
 	writer   *bufio.Writer
+	protocol int
+	mutex    sync.RWMutex // guards protocol, name and lastRead, shared by the read and write threads
+	done     chan bool    // closed once the write thread has finished
+	ircUser  string       // set by USER, irc clients are registered once they send NICK and USER
+	ircReady bool
+	ircNick  bool         // set once NICK has been accepted
+	certName string       // CN of the client certificate with mutual TLS, fixes the name
+	before   uint64       // oldest frame id the client has seen, where /history carries on from
+	account  string       // registered name they logged in as, empty for guests
+	token    string       // hands their session to a new connection if this one drops
+	quitting bool         // left with /q, so nothing is held for them
+	lastRead time.Time    // when they last sent a command or message, they are idle after IDLE_TIME
+	away     string       // why they are away, empty while they are here
+	connected time.Time   // shown by /whois
+	suggestion string     // room offered after a mistyped /j, joined by /y
+	hashing  bool         // a /login or /register is being checked, they only get one at a time
+}
+
+// settings read from config.json, a missing file leaves everything off
+type Config struct {
+	TLS     TLSConfig
+	Journal string // where rooms and history are kept between restarts
+	Users   string // where registered names are kept
+	History HistoryConfig
+	ExpiryWarning string // like "1h", warns occupants that long before a room is archived. "0" for no warning
+	ResumeGrace   string // like "5m", how long a dropped client can /resume. "0" turns it off
+	Announcements AnnouncementsConfig
+
+	expiryWarning time.Duration
+	resumeGrace   time.Duration
+}
+
+/* the read-only room everyone joins on connect. its description is the
+ * welcome, an empty Room sends the welcome as a notice instead */
+type AnnouncementsConfig struct {
+	Room    string
+	Welcome string
+	Accounts []string // registered names that moderate it, besides anyone they /op
+	Hosts    []string // clients connecting from these do too, anyone on the machine if it is "127.0.0.1"
+}
+
+// how much of each room's backlog is kept and replayed, 0 keeps everything
+type HistoryConfig struct {
+	MaxMessages int
+	MaxBytes    int
+	Replay      int
+}
+
+// TLS for the tcp, irc and websocket listeners
+type TLSConfig struct {
+	Enabled      bool
+	CertFile     string
+	KeyFile      string
+	GenerateCert bool   // writes a self-signed dev certificate to CertFile/KeyFile if missing
+	ClientAuth   bool   // requires client certificates signed by CAFile, the CN becomes the name
+	CAFile       string
+}
+
+// one line from an irc client, "[:prefix] COMMAND params [:trailing]"
+type IRCCommand struct {
+	command string
+	params  []string
+}
+
+/* Adapts a websocket to the line based reader the Client expects. Each
+ * websocket message is one line, so browsers dont have to send the '\n' */
+type WSConn struct {
+	*websocket.Conn
+	pending []byte
+}
+
+// remote address of a websocket client, taken from the http request
+type WSAddr string
+
+/* Telnet aware connection. Reading strips negotiation out of the stream and
+ * does the line editing (backspace, CR/LF), so the Client only ever sees
+ * clean lines. Once the client agrees the server echoes input itself, and
+ * output is wrapped to the window size the client sent with NAWS */
+type TelnetConn struct {
+	net.Conn
+	buf     []byte
+	pending []byte        // finished lines not read yet
+	state   int
+	verb    byte          // WILL/WONT/DO/DONT waiting for its option
+	sb      []byte        // subnegotiation being collected
+	sawCR   bool          // swallow the LF or NUL after a CR
+	sentWill map[byte]bool
+	sentDo   map[byte]bool
+
+	mutex   sync.Mutex    // guards everything below, shared with the write thread
+	telnet  bool          // the other end has shown it speaks telnet
+	echo    bool          // server side echo is on
+	width   int           // columns from NAWS, 0 means dont wrap
+	column  int
+	line    []byte        // line being typed, redrawn after output when echoing
 }
 
-// Contains the name of the sender, time, and text of a message
+// Contains the name of the sender, time, and text of a message.
+// raw messages came from a framed "msg" and are never parsed as commands
 type Message struct {
 	time   time.Time
 	client *Client
 	text   string
+	raw    bool
+}
+
+/* Versioned envelope for everything the server sends. Framed clients get it
+ * as one line of JSON, plain text clients get String() instead */
+type Frame struct {
+	Version int       `json:"v"`
+	Type    string    `json:"type"`
+	Room    string    `json:"room,omitempty"`
+	Sender  string    `json:"sender,omitempty"`
+	Time    time.Time `json:"ts"`
+	Id      uint64    `json:"id"`
+	Payload string    `json:"payload"`
+	To      string    `json:"to,omitempty"` // recipient of a private message, sent without a room
+	from    *Client   // sender, irc clients dont get their own messages echoed
+}
+
+// last frame id handed out, frames are created from several threads
+var lastFrameId uint64
+
+// create lobby, with the rooms the journal remembers, and start its thread
+func NewLobby(config *Config, clock Clock) *Lobby {
+	lobby := OpenLobby(config, clock)
+	lobby.Listen()
+	return lobby
 }
 
-// create lobby
-func NewLobby() *Lobby {
+/* sets up the lobby without starting its thread, the caller acts as the
+ * lobby thread. rooms expire by the clock */
+func OpenLobby(config *Config, clock Clock) *Lobby {
 	lobby := &Lobby{
 		clients:   make([]*Client, 0),
 		chatRooms: make(map[string]*ChatRoom),
 		incoming:  make(chan *Message),
 		join:      make(chan *Client),
 		leave:     make(chan *Client),
-		delete:    make(chan *ChatRoom),
+		history:   &config.History,
+		scheduler: NewScheduler(clock),
+		archives:  make(map[string]*ChatRoom),
+		warning:   config.expiryWarning,
+		logins:    make(chan *Login),
+		hashing:   make(chan bool, HASH_WORKERS),
+		failedLogins: make(map[string]*LoginFailures),
+		sessions:  make(map[string]*Session),
+		resumeGrace: config.resumeGrace,
 	}
-	lobby.Listen()
+	users, err := LoadUsers(config.Users)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	lobby.users = users
+	lobby.Restore(config.Journal)
+	lobby.OpenAnnouncements(&config.Announcements)
 	return lobby
 }
 
+/* replays the journal into chatRooms, drops rooms that expired while the
+ * server was down, then rewrites the journal from what is left */
+func (lobby *Lobby) Restore(path string) {
+	entries, err := ReadJournal(path)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	mutes := make(map[*ChatRoom]map[string]time.Time)
+	for _, entry := range entries {
+		chatRoom := lobby.chatRooms[entry.Room]
+		switch entry.Op {
+		case JOURNAL_CREATE:
+			chatRoom = NewChatRoom(entry.Room, lobby)
+			chatRoom.expiry = entry.Time.Add(EXPIRY_TIME)
+			chatRoom.secret = entry.Secret
+			chatRoom.owner = entry.Owner
+			if entry.Owner != "" {
+				chatRoom.members[entry.Owner] = true
+			}
+			chatRoom.inviteOnly = entry.InviteOnly
+			chatRoom.readOnly = entry.ReadOnly
+			lobby.chatRooms[entry.Room] = chatRoom
+		case JOURNAL_INVITE:
+			if chatRoom != nil {
+				chatRoom.inviteOnly = true
+			}
+		case JOURNAL_BAN:
+			if chatRoom != nil {
+				chatRoom.bans[entry.Name] = entry.Host
+				delete(chatRoom.members, entry.Name)
+				delete(chatRoom.moderators, entry.Name)
+			}
+		case JOURNAL_OP:
+			if chatRoom != nil {
+				chatRoom.moderators[entry.Name] = true
+			}
+		case JOURNAL_MUTE:
+			if chatRoom != nil && entry.Until != nil {
+				if mutes[chatRoom] == nil {
+					mutes[chatRoom] = make(map[string]time.Time)
+				}
+				mutes[chatRoom][entry.Name] = *entry.Until
+			}
+		case JOURNAL_MEMBER:
+			if chatRoom != nil {
+				chatRoom.members[entry.Name] = true
+			}
+		case JOURNAL_OWNER:
+			if chatRoom != nil {
+				chatRoom.owner = entry.Name
+				chatRoom.members[entry.Name] = true
+			}
+		case JOURNAL_UNBAN:
+			if chatRoom != nil {
+				delete(chatRoom.bans, entry.Name)
+			}
+		case JOURNAL_READONLY:
+			if chatRoom != nil {
+				chatRoom.readOnly = entry.ReadOnly
+			}
+		case JOURNAL_TOPIC:
+			if chatRoom != nil {
+				chatRoom.topic, chatRoom.description = entry.Topic, entry.Description
+			}
+		case JOURNAL_MESSAGE:
+			if chatRoom == nil || entry.Frame == nil {
+				continue
+			}
+			chatRoom.Record(entry.Frame)
+			if expiry := entry.Time.Add(EXPIRY_TIME); expiry.After(chatRoom.expiry) {
+				chatRoom.expiry = expiry
+			}
+			// keep frame ids increasing across restarts
+			if entry.Frame.Id > atomic.LoadUint64(&lastFrameId) {
+				atomic.StoreUint64(&lastFrameId, entry.Frame.Id)
+			}
+		case JOURNAL_DELETE:
+			delete(lobby.chatRooms, entry.Room)
+			delete(lobby.archives, entry.Room)
+		case JOURNAL_ARCHIVE:
+			if chatRoom != nil {
+				chatRoom.archived = entry.Time
+				lobby.archives[entry.Room] = chatRoom
+				delete(lobby.chatRooms, entry.Room)
+			}
+		case JOURNAL_RESTORE:
+			if chatRoom = lobby.archives[entry.Room]; chatRoom != nil {
+				chatRoom.archived = time.Time{}
+				chatRoom.expiry = entry.Time.Add(EXPIRY_TIME)
+				lobby.chatRooms[entry.Room] = chatRoom
+				delete(lobby.archives, entry.Room)
+			}
+		}
+	}
+
+	// rooms that expired while the server was down go straight to the archive
+	for name, chatRoom := range lobby.chatRooms {
+		if !chatRoom.expiry.After(lobby.scheduler.Now()) {
+			chatRoom.archived = chatRoom.expiry
+			lobby.archives[name] = chatRoom
+			delete(lobby.chatRooms, name)
+			continue
+		}
+		lobby.ScheduleExpiry(chatRoom)
+	}
+	for name, chatRoom := range lobby.archives {
+		if !chatRoom.archived.Add(ARCHIVE_TIME).After(lobby.scheduler.Now()) {
+			delete(lobby.archives, name)
+			continue
+		}
+		lobby.SchedulePurge(chatRoom)
+	}
+	lobby.TrimArchives()
+	for chatRoom, muted := range mutes {
+		for name, until := range muted {
+			if left := until.Sub(lobby.scheduler.Now()); left > 0 {
+				lobby.Silence(chatRoom, name, left)
+			}
+		}
+	}
+
+	lobby.journal, err = CreateJournal(path, lobby.chatRooms, lobby.archives)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	for _, chatRoom := range lobby.chatRooms {
+		chatRoom.journal = lobby.journal
+	}
+	for _, chatRoom := range lobby.archives {
+		chatRoom.journal = lobby.journal
+	}
+	log.Printf("restored %d chat rooms and %d archived ones from %s\n", len(lobby.chatRooms), len(lobby.archives), path)
+}
+
+/* creates the room everyone joins on connect, or brings it back if it was
+ * archived, and keeps it read-only with the configured welcome */
+func (lobby *Lobby) OpenAnnouncements(config *AnnouncementsConfig) {
+	if config.Room == "" {
+		return
+	}
+	if chatRoom := lobby.archives[config.Room]; chatRoom != nil {
+		lobby.Unarchive(chatRoom)
+	}
+	chatRoom := lobby.chatRooms[config.Room]
+	if chatRoom == nil {
+		chatRoom = NewChatRoom(config.Room, lobby)
+		chatRoom.readOnly = true
+		lobby.chatRooms[config.Room] = chatRoom
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_CREATE, Room: config.Room, ReadOnly: true})
+		lobby.ScheduleExpiry(chatRoom)
+	}
+	if !chatRoom.readOnly {
+		chatRoom.readOnly = true
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_READONLY, Room: config.Room, ReadOnly: true})
+	}
+	if chatRoom.description != config.Welcome {
+		chatRoom.description = config.Welcome
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_TOPIC, Room: config.Room, Topic: chatRoom.topic, Description: config.Welcome})
+	}
+	chatRoom.announcers = config
+	lobby.announcements = chatRoom
+}
+
 // new lobby thread, listens for messages
 func (lobby *Lobby) Listen() {
 	go func() {
@@ -111,8 +828,10 @@ func (lobby *Lobby) Listen() {
 				lobby.Join(client)
 			case client := <-lobby.leave:
 				lobby.Leave(client)
-			case chatRoom := <-lobby.delete:
-				lobby.DeleteChatRoom(chatRoom)
+			case login := <-lobby.logins:
+				lobby.FinishLogin(login)
+			case <-lobby.scheduler.Wake():
+				lobby.scheduler.Run()
 			}
 		}
 	}()
@@ -121,11 +840,25 @@ func (lobby *Lobby) Listen() {
 // handles lobby connections
 func (lobby *Lobby) Join(client *Client) {
 	if len(lobby.clients) >= MAX_CLIENTS {
-		client.Quit()
+		lobby.Refuse(client, "")
+		return
+	}
+	if client.certName == "" {
+		client.SetName(lobby.GuestName())
+	} else if refusal := lobby.ClaimCertName(client); refusal != "" {
+		lobby.Refuse(client, refusal)
+		log.Println("client's certificate name is taken")
 		return
 	}
 	lobby.clients = append(lobby.clients, client)
-	client.outgoing <- MSG_CONNECT
+	if client.Protocol() != PROTO_IRC {
+		// irc clients join once they have registered
+		lobby.JoinAnnouncements(client)
+		if lobby.resumeGrace > 0 {
+			client.token = NewToken()
+			client.Notice(fmt.Sprintf(NOTICE_TOKEN, lobby.resumeGrace, client.token))
+		}
+	}
 	go func() {
 		for message := range client.incoming {
 			lobby.incoming <- message
@@ -134,10 +867,84 @@ func (lobby *Lobby) Join(client *Client) {
 	}()
 }
 
-// handles lobby disconnections
+/* turns away a client that never made it into the lobby, telling them why
+ * if there is a reason. nothing else will close outgoing, and websocket
+ * handlers wait on it. Read can still send on outgoing, so it is stopped
+ * with a deadline and outgoing only closed once incoming has been */
+func (lobby *Lobby) Refuse(client *Client, reason string) {
+	if reason != "" {
+		client.Error(reason)
+	}
+	client.conn.SetReadDeadline(time.Now())
+	go func() {
+		for _ = range client.incoming {
+		}
+		close(client.outgoing)
+		<-client.done
+		client.Quit()
+	}()
+}
+
+/* why the client cant have the name from their certificate, empty if they
+ * can. the certificate wins over a guest or a held session using the name,
+ * but not over a registered name or another connection with the same
+ * certificate */
+func (lobby *Lobby) ClaimCertName(client *Client) string {
+	name := client.certName
+	other := lobby.FindClient(name)
+	if lobby.users.accounts[name] != nil || (other != nil && other.certName != "") {
+		return fmt.Sprintf(ERROR_CERT_TAKEN, name)
+	}
+	if token, _ := lobby.HeldFor(name); token != "" {
+		lobby.DropSession(token)
+	}
+	if other != nil {
+		other.Notice(fmt.Sprintf(NOTICE_CERT_RENAMED, name))
+		lobby.ChangeName(other, lobby.GuestName())
+	}
+	return ""
+}
+
+/* puts a new client in the announcements room, which shows them the welcome.
+ * clients from the configured hosts can post there */
+func (lobby *Lobby) JoinAnnouncements(client *Client) {
+	chatRoom := lobby.announcements
+	if chatRoom == nil {
+		client.Notice(MSG_CONNECT)
+		return
+	}
+	if chatRoom.Banned(client) {
+		return
+	}
+	lobby.AddMember(chatRoom, client)
+	if client.Protocol() == PROTO_IRC {
+		client.Raw(fmt.Sprintf(":%s!%s@%s JOIN #%s", client.name, client.name, IRC_SERVER, chatRoom.name))
+		chatRoom.Join(client)
+		lobby.TopicIRC(client, chatRoom)
+		lobby.NamesIRC(client, chatRoom.name)
+		if chatRoom.description != "" {
+			client.Notice(chatRoom.description)
+		}
+		return
+	}
+	chatRoom.Join(client)
+}
+
+/* handles lobby disconnections. unless they quit, what they had is held
+ * for a while in case they reconnect */
 func (lobby *Lobby) Leave(client *Client) {
-	if client.chatRoom != nil {
-		client.chatRoom.Leave(client)
+	var session *Session
+	if client.token != "" && !client.quitting {
+		session = &Session{
+			name:      client.Name(),
+			account:   client.account,
+			away:      client.away,
+			chatRooms: append([]*ChatRoom(nil), client.chatRooms...),
+			chatRoom:  client.chatRoom,
+		}
+	}
+	for len(client.chatRooms) > 0 {
+		client.chatRooms[0].Leave(client)
 	}
 	for i, otherClient := range lobby.clients {
 		if client == otherClient {
@@ -147,258 +954,3303 @@ func (lobby *Lobby) Leave(client *Client) {
 	}
 	close(client.outgoing)
 	log.Println("Closed client's outgoing channel")
+	if session == nil {
+		lobby.Release(client)
+		return
+	}
+	// after leaving, so they arent replayed their own departure
+	session.lastId = atomic.LoadUint64(&lastFrameId)
+	session.expire = lobby.scheduler.After(lobby.resumeGrace, func() {
+		delete(lobby.sessions, client.token)
+		lobby.Release(client)
+	})
+	lobby.sessions[client.token] = session
 }
 
-// checks if channel is expired, deletes if so, sets new expiry time otherwise 
-func (lobby *Lobby) DeleteChatRoom(chatRoom *ChatRoom) {
-	if chatRoom.expiry.After(time.Now()) {
-		go func() {
-			time.Sleep(chatRoom.expiry.Sub(time.Now()))
-			lobby.delete <- chatRoom
-		}()
-		log.Println("attempted to delete chat room")
-	} else {
-		chatRoom.Delete()
-		delete(lobby.chatRooms, chatRoom.name)
-		log.Println("deleted chat room")
+/* who room ownership and membership belong to: the registered name they
+ * logged in as, so it lasts across reconnects and restarts, or their name
+ * for guests, which only lasts while they are connected */
+func (client *Client) Identity() string {
+	if client.account != "" {
+		return client.account
 	}
+	return client.Name()
 }
 
-// creates a chatroom, unless that name is already in use
-func (lobby *Lobby) CreateChatRoom(client *Client, name string) {
-	if lobby.chatRooms[name] != nil {
-		client.outgoing <- ERROR_CREATE
-		log.Println("client tried to create chat room with a name already in use")
-		return
+// the rooms, open or archived, that an identity might have a hold on
+func (lobby *Lobby) AllChatRooms() []*ChatRoom {
+	chatRooms := make([]*ChatRoom, 0, len(lobby.chatRooms)+len(lobby.archives))
+	for _, chatRoom := range lobby.chatRooms {
+		chatRooms = append(chatRooms, chatRoom)
 	}
-	chatRoom := NewChatRoom(name)
-	lobby.chatRooms[name] = chatRoom
-	go func() {
-		time.Sleep(EXPIRY_TIME)
-		lobby.delete <- chatRoom
-	}()
-	client.outgoing <- fmt.Sprintf(NOTICE_LOBBY_CREATE, chatRoom.name)
-	log.Println("client created chat room")
+	for _, chatRoom := range lobby.archives {
+		chatRooms = append(chatRooms, chatRoom)
+	}
+	return chatRooms
 }
 
-/* joins a chat room (if it exists, warning otherwise). 
- * could have it create that room if it didnt exist and then join,
- * but then people could join rooms by mistake that are likely empty
- * example /j genral instead of /j general */
-func (lobby *Lobby) JoinChatRoom(client *Client, name string) {
-	if lobby.chatRooms[name] == nil {
-		client.outgoing <- ERROR_JOIN
-		log.Println("client tried to join a chat room that does not exist")
+// lets the client into the room for good, registered names are journaled
+func (lobby *Lobby) AddMember(chatRoom *ChatRoom, client *Client) {
+	if chatRoom.members[client.Identity()] {
 		return
 	}
-	if client.chatRoom != nil {
-		lobby.LeaveChatRoom(client)
+	chatRoom.members[client.Identity()] = true
+	if client.account != "" {
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_MEMBER, Room: chatRoom.name, Name: client.account})
 	}
-	lobby.chatRooms[name].Join(client)
-	log.Println("client joined chat room")
 }
 
-// leaves chat room
-func (lobby *Lobby) LeaveChatRoom(client *Client) {
-	if client.chatRoom == nil {
-		client.outgoing <- ERROR_LEAVE
-		log.Println("client tried to leave the lobby")
+/* moves a guest's rooms over when their identity changes, to a new name
+ * or to the account they logged in as */
+func (lobby *Lobby) Rekey(client *Client, from string) {
+	to := client.Identity()
+	if from == to {
 		return
 	}
-	client.chatRoom.Leave(client)
-	log.Println("client left chat room")
-}
-
-// lists currently open chat rooms
-func (lobby *Lobby) ListChatRooms(client *Client) {
-	client.outgoing <- "\n"
-	client.outgoing <- "Chat Rooms:\n"
-	for name := range lobby.chatRooms {
-		client.outgoing <- fmt.Sprintf("%s\n", name)
+	for _, chatRoom := range lobby.AllChatRooms() {
+		if chatRoom.members[from] {
+			delete(chatRoom.members, from)
+			lobby.AddMember(chatRoom, client)
+		}
+		if chatRoom.owner == from {
+			chatRoom.owner = to
+			if client.account != "" {
+				lobby.journal.Append(&JournalEntry{Op: JOURNAL_OWNER, Room: chatRoom.name, Name: to})
+			}
+		}
+		if chatRoom.moderators[from] {
+			delete(chatRoom.moderators, from)
+			lobby.AddModerator(chatRoom, client)
+		}
+		if entry := chatRoom.muted[from]; entry != nil {
+			lobby.scheduler.Cancel(entry)
+			delete(chatRoom.muted, from)
+			lobby.Mute(chatRoom, client, entry.at.Sub(lobby.scheduler.Now()))
+		}
 	}
-	client.outgoing <- "\n"
-	log.Println("client listed chat rooms")
 }
 
-// creates a new chat room, sets expiration date
-func NewChatRoom(name string) *ChatRoom {
-	return &ChatRoom{
-		name:     name,
-		clients:  make([]*Client, 0),
-		messages: make([]string, 0),
-		expiry:   time.Now().Add(EXPIRY_TIME),
+/* a guest that has gone for good gives up their rooms, so whoever takes
+ * the name next doesnt get them. registered names keep theirs */
+func (lobby *Lobby) Release(client *Client) {
+	if client.account != "" {
+		return
 	}
-}
-
-
-// checks for prefix commands first, otherwise sends a message 
-func (lobby *Lobby) Parse(message *Message) {
-	switch {
-	default:
-		lobby.SendMessage(message)
-	case strings.HasPrefix(message.text, CMD_CREATE):
-		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CMD_CREATE+" "), "\n")
-		lobby.CreateChatRoom(message.client, name)
-	case strings.HasPrefix(message.text, CMD_LEAVE):
-		lobby.LeaveChatRoom(message.client)
-	case strings.HasPrefix(message.text, CMD_LIST):
-		lobby.ListChatRooms(message.client)
-	case strings.HasPrefix(message.text, CMD_JOIN):
-		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CMD_JOIN+" "), "\n")
-		lobby.JoinChatRoom(message.client, name)
-	case strings.HasPrefix(message.text, CMD_NAME):
-		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CMD_NAME+" "), "\n")
-		lobby.ChangeName(message.client, name)
-	case strings.HasPrefix(message.text, CMD_HELP):
-		lobby.Help(message.client)
-	case strings.HasPrefix(message.text, CMD_QUIT):
-		message.client.Quit()
+	for _, chatRoom := range lobby.AllChatRooms() {
+		delete(chatRoom.members, client.Name())
+		delete(chatRoom.moderators, client.Name())
+		if chatRoom.owner == client.Name() {
+			chatRoom.owner = ""
+		}
+		if entry := chatRoom.muted[client.Name()]; entry != nil {
+			lobby.scheduler.Cancel(entry)
+			delete(chatRoom.muted, client.Name())
+		}
 	}
 }
 
-// sends message to chat room. error message if in the lobbby
-func (lobby *Lobby) SendMessage(message *Message) {
-	if message.client.chatRoom == nil {
-		message.client.outgoing <- ERROR_SEND
-		log.Println("client tried to send message in lobby")
-		return
+// makes the client a moderator of the room, registered names are journaled
+func (lobby *Lobby) AddModerator(chatRoom *ChatRoom, client *Client) {
+	chatRoom.moderators[client.Identity()] = true
+	if client.account != "" {
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_OP, Room: chatRoom.name, Name: client.account})
 	}
-	message.client.chatRoom.Broadcast(message.String())
-	log.Println("client sent message")
 }
 
-// change user name
-func (lobby *Lobby) ChangeName(client *Client, name string) {
-	if client.chatRoom == nil {
-		client.outgoing <- (fmt.Sprintf(NOTICE_ROOM_NAME, client.name, name))
-	} else {
-		client.chatRoom.Broadcast(fmt.Sprintf(NOTICE_ROOM_NAME, client.name, name))
+/* mutes the client in the room for duration, by identity so reconnecting
+ * doesnt end it. registered names are journaled so restarting doesnt either */
+func (lobby *Lobby) Mute(chatRoom *ChatRoom, client *Client, duration time.Duration) {
+	lobby.Silence(chatRoom, client.Identity(), duration)
+	if client.account != "" {
+		until := lobby.scheduler.Now().Add(duration)
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_MUTE, Room: chatRoom.name, Name: client.account, Until: &until})
 	}
-	client.name = name
-	log.Println("client changed their name")
 }
 
-// sends list of commands
-func (lobby *Lobby) Help(client *Client) {
-	client.outgoing <- "\n"
-	client.outgoing <- "Commands:\n"
-	client.outgoing <- CMD_HELP +" - lists all commands\n"
-	client.outgoing <- CMD_LIST + " - lists all chat rooms\n"
-	client.outgoing <- CMD_CREATE + " test - creates a chat room named test\n"
-	client.outgoing <- CMD_JOIN + " test - joins a chat room named test\n"
-	client.outgoing <- CMD_LEAVE + " - leaves the current chat room\n"
-	client.outgoing <- CMD_NAME + " test - changes your name to test\n"
-	client.outgoing <- CMD_QUIT + " - quits the program\n"
-	client.outgoing <- "\n"
-	log.Println("client requested help")
+// the session holding a name for a dropped client, nil if there isnt one
+func (lobby *Lobby) HeldFor(name string) (string, *Session) {
+	for token, session := range lobby.sessions {
+		if session.name == name {
+			return token, session
+		}
+	}
+	return "", nil
 }
 
-// sends all of the previous message upon joining the chat room
-func (chatRoom *ChatRoom) Join(client *Client) {
-	client.chatRoom = chatRoom
-	for _, message := range chatRoom.messages {
-		client.outgoing <- message
+// forgets a held session, it can no longer be resumed
+func (lobby *Lobby) DropSession(token string) {
+	if session := lobby.sessions[token]; session != nil {
+		lobby.scheduler.Cancel(session.expire)
+		delete(lobby.sessions, token)
 	}
-	chatRoom.clients = append(chatRoom.clients, client)
-	chatRoom.Broadcast(fmt.Sprintf(NOTICE_ROOM_JOIN, client.name))
 }
 
-// Removes client from chat room.
-func (chatRoom *ChatRoom) Leave(client *Client) {
-	chatRoom.Broadcast(fmt.Sprintf(NOTICE_ROOM_LEAVE, client.name))
-	for i, otherClient := range chatRoom.clients {
-		if client == otherClient {
-			chatRoom.clients = append(chatRoom.clients[:i], chatRoom.clients[i+1:]...)
-			break
+/* gives the client the name and rooms of the dropped connection the token
+ * was issued to, and sends them what was said in those rooms meanwhile.
+ * rooms that were archived or banned them since are skipped */
+func (lobby *Lobby) Resume(client *Client, token string) {
+	session := lobby.sessions[token]
+	if session == nil {
+		client.Error(ERROR_RESUME)
+		log.Println("client tried to resume with a bad token")
+		return
+	}
+	lobby.DropSession(token)
+	if client.account == "" && session.account != "" {
+		from := client.Identity()
+		client.account = session.account
+		lobby.Rekey(client, from)
+	}
+	client.away = session.away
+	if client.certName == "" && client.Name() != session.name {
+		lobby.ChangeName(client, session.name)
+	}
+	for _, chatRoom := range session.chatRooms {
+		if lobby.chatRooms[chatRoom.name] != chatRoom || chatRoom.Banned(client) {
+			continue
+		}
+		if !chatRoom.Present(client) {
+			chatRoom.ReplaySince(client, session.lastId)
+			client.chatRooms = append(client.chatRooms, chatRoom)
+			chatRoom.clients = append(chatRoom.clients, client)
+			chatRoom.Presence(fmt.Sprintf(NOTICE_ROOM_BACK, client.name))
 		}
 	}
-	client.chatRoom = nil
-}
-
-// sends the current chatroom the message
-func (chatRoom *ChatRoom) Broadcast(message string) {
-	chatRoom.expiry = time.Now().Add(EXPIRY_TIME)
-	chatRoom.messages = append(chatRoom.messages, message)
-	for _, client := range chatRoom.clients {
-		client.outgoing <- message
+	if chatRoom := session.chatRoom; chatRoom != nil && chatRoom.Present(client) {
+		client.chatRoom = chatRoom
+	} else if len(client.chatRooms) > 0 {
+		// the one they were talking in is gone, like Forget pick the newest
+		client.chatRoom = client.chatRooms[len(client.chatRooms)-1]
 	}
+	client.Notice(fmt.Sprintf(NOTICE_RESUMED, client.Name()))
+	log.Println("client resumed their session")
 }
 
-// Notifies the clients within the chat room that it is being deleted, and kicks
-// them back into the lobby.
-func (chatRoom *ChatRoom) Delete() {
-	//notify of deletion?
-	chatRoom.Broadcast(NOTICE_ROOM_DELETE)
-	for _, client := range chatRoom.clients {
-		client.chatRoom = nil
+/* checks the room when it is due to expire, it may have been used since.
+ * the occupants are warned a while before */
+func (lobby *Lobby) ScheduleExpiry(chatRoom *ChatRoom) {
+	chatRoom.expire = lobby.scheduler.At(chatRoom.expiry, func() {
+		lobby.DeleteChatRoom(chatRoom)
+	})
+	if lobby.warning > 0 {
+		chatRoom.warn = lobby.scheduler.At(chatRoom.expiry.Add(-lobby.warning), func() {
+			lobby.WarnChatRoom(chatRoom)
+		})
 	}
 }
 
+// tells the occupants the room is about to be archived, unless it was used since
+func (lobby *Lobby) WarnChatRoom(chatRoom *ChatRoom) {
+	if chatRoom == lobby.announcements {
+		return
+	}
+	warnAt := chatRoom.expiry.Add(-lobby.warning)
+	if warnAt.After(lobby.scheduler.Now()) {
+		lobby.scheduler.Reschedule(chatRoom.warn, warnAt)
+		return
+	}
+	left := chatRoom.expiry.Sub(lobby.scheduler.Now()).Round(time.Second)
+	chatRoom.Notify(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_EXPIRING, left)))
+}
+
+// checks if channel is expired, archives it if so, sets new expiry time otherwise 
+func (lobby *Lobby) DeleteChatRoom(chatRoom *ChatRoom) {
+	if chatRoom == lobby.announcements {
+		// stays open however quiet it gets
+		chatRoom.expiry = lobby.scheduler.Now().Add(EXPIRY_TIME)
+	}
+	if chatRoom.expiry.After(lobby.scheduler.Now()) {
+		lobby.scheduler.Reschedule(chatRoom.expire, chatRoom.expiry)
+		// warn again if the room was used after the last warning
+		if warnAt := chatRoom.expiry.Add(-lobby.warning); chatRoom.warn != nil && warnAt.After(lobby.scheduler.Now()) {
+			lobby.scheduler.Reschedule(chatRoom.warn, warnAt)
+		}
+		log.Println("attempted to delete chat room")
+	} else {
+		lobby.scheduler.Cancel(chatRoom.warn)
+		chatRoom.Archive()
+		chatRoom.archived = lobby.scheduler.Now()
+		delete(lobby.chatRooms, chatRoom.name)
+		lobby.archives[chatRoom.name] = chatRoom
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_ARCHIVE, Room: chatRoom.name})
+		lobby.SchedulePurge(chatRoom)
+		lobby.TrimArchives()
+		log.Println("archived chat room")
+	}
+}
+
+// drops the archived room for good once it has been archived ARCHIVE_TIME
+func (lobby *Lobby) SchedulePurge(chatRoom *ChatRoom) {
+	chatRoom.purge = lobby.scheduler.At(chatRoom.archived.Add(ARCHIVE_TIME), func() {
+		lobby.Purge(chatRoom)
+	})
+}
+
+// forgets an archived room and its history, the name is free again
+func (lobby *Lobby) Purge(chatRoom *ChatRoom) {
+	lobby.scheduler.Cancel(chatRoom.purge)
+	delete(lobby.archives, chatRoom.name)
+	if lobby.journal != nil {
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_DELETE, Room: chatRoom.name})
+	}
+	log.Println("purged archived chat room")
+}
+
+/* purges the oldest archives until there are no more than MAX_ARCHIVES.
+ * rooms archived together go by which was used last */
+func (lobby *Lobby) TrimArchives() {
+	for len(lobby.archives) > MAX_ARCHIVES {
+		var oldest *ChatRoom
+		for _, chatRoom := range lobby.archives {
+			switch {
+			case oldest == nil, chatRoom.archived.Before(oldest.archived):
+				oldest = chatRoom
+			case chatRoom.archived.Equal(oldest.archived) && chatRoom.expiry.Before(oldest.expiry):
+				oldest = chatRoom
+			}
+		}
+		lobby.Purge(oldest)
+	}
+}
+
+// moves a room out of the archive with a fresh expiry
+func (lobby *Lobby) Unarchive(chatRoom *ChatRoom) {
+	lobby.scheduler.Cancel(chatRoom.purge)
+	delete(lobby.archives, chatRoom.name)
+	chatRoom.archived = time.Time{}
+	chatRoom.expiry = lobby.scheduler.Now().Add(EXPIRY_TIME)
+	lobby.chatRooms[chatRoom.name] = chatRoom
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_RESTORE, Room: chatRoom.name})
+	lobby.ScheduleExpiry(chatRoom)
+}
+
+// lists the archived rooms the client could see when they were open
+func (lobby *Lobby) ListArchives(client *Client) {
+	chatRooms := make([]*ChatRoom, 0, len(lobby.archives))
+	for _, chatRoom := range lobby.archives {
+		if chatRoom.Visible(client) {
+			chatRooms = append(chatRooms, chatRoom)
+		}
+	}
+	SortChatRooms(chatRooms, LIST_SORT_NAME)
+
+	list := "\nArchived Chat Rooms:\n"
+	for _, chatRoom := range chatRooms {
+		list += fmt.Sprintf("%s - archived %s, %d messages", chatRoom.name, chatRoom.archived.Format(LIST_TIME_FORMAT), len(chatRoom.messages))
+		if chatRoom.topic != "" {
+			list += " - " + chatRoom.topic
+		}
+		list += "\n"
+	}
+	client.Info(list)
+	log.Println("client listed archived chat rooms")
+}
+
+/* reopens an archived room with its history. one with an owner is theirs
+ * to bring back, anyone can restore the rest */
+func (lobby *Lobby) RestoreChatRoom(client *Client, name string) {
+	chatRoom := lobby.archives[name]
+	if chatRoom == nil || !chatRoom.Visible(client) {
+		client.Error(ERROR_RESTORE)
+		return
+	}
+	if chatRoom.owner != "" && !chatRoom.OwnedBy(client) {
+		client.Error(fmt.Sprintf(ERROR_RESTORE_OWNER, name))
+		log.Println("client tried to restore someone else's chat room")
+		return
+	}
+	lobby.Unarchive(chatRoom)
+	client.Notice(fmt.Sprintf(NOTICE_LOBBY_RESTORE, name, name))
+	log.Println("client restored a chat room")
+}
+
+// creates a chatroom, unless that name is already in use
+func (lobby *Lobby) CreateChatRoom(client *Client, name string, password string) {
+	if name == "" {
+		client.Error(ERROR_ROOM_NAME)
+		return
+	}
+	if lobby.chatRooms[name] != nil {
+		client.Error(ERROR_CREATE)
+		log.Println("client tried to create chat room with a name already in use")
+		return
+	}
+	if lobby.archives[name] != nil {
+		client.Error(fmt.Sprintf(ERROR_ARCHIVED, name))
+		return
+	}
+	if password == "" {
+		lobby.OpenChatRoom(client, name, "")
+		return
+	}
+	if client.account == "" {
+		client.Error(ERROR_PRIVATE)
+		return
+	}
+	// the password is hashed off the lobby thread, the room opens once it is back
+	if !lobby.StartHashing(client) {
+		return
+	}
+	go func() {
+		lobby.hashing <- true
+		secret := HashSecret(password)
+		<-lobby.hashing
+		lobby.logins <- &Login{client: client, room: name, secret: secret}
+	}()
+}
+
+// opens a new room owned by the client, private if it has a secret
+func (lobby *Lobby) OpenChatRoom(client *Client, name string, secret string) {
+	chatRoom := NewChatRoom(name, lobby)
+	chatRoom.owner = client.Identity()
+	chatRoom.members[client.Identity()] = true
+	chatRoom.secret = secret
+	lobby.chatRooms[name] = chatRoom
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_CREATE, Room: name, Secret: chatRoom.secret, Owner: client.account})
+	lobby.ScheduleExpiry(chatRoom)
+	if secret != "" {
+		client.Notice(fmt.Sprintf(NOTICE_LOBBY_PRIVATE, chatRoom.name))
+	} else {
+		client.Notice(fmt.Sprintf(NOTICE_LOBBY_CREATE, chatRoom.name))
+	}
+	log.Println("client created chat room")
+}
+
+/* lets the named client into the creator's current room, which makes the
+ * room invite-only */
+func (lobby *Lobby) Invite(client *Client, name string) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !chatRoom.OwnedBy(client) {
+		client.Error(ERROR_INVITE)
+		log.Println("client tried to invite without owning the chat room")
+		return
+	}
+	if client.account == "" {
+		// an invite-only room nobody can get back into would be lost
+		client.Error(ERROR_PRIVATE)
+		return
+	}
+	invitee := lobby.FindClient(name)
+	if invitee == nil {
+		client.Error(fmt.Sprintf(ERROR_NICK, name))
+		return
+	}
+	if !chatRoom.inviteOnly {
+		chatRoom.inviteOnly = true
+		lobby.journal.Append(&JournalEntry{Op: JOURNAL_INVITE, Room: chatRoom.name})
+	}
+	lobby.AddMember(chatRoom, invitee)
+	invitee.Notice(fmt.Sprintf(NOTICE_INVITED, client.Name(), chatRoom.name, chatRoom.name))
+	client.Notice(fmt.Sprintf(NOTICE_ROOM_INVITE, invitee.Name(), chatRoom.name))
+	log.Println("client invited someone to a chat room")
+}
+
+/* shows the current room's topic, or sets it with "topic | description".
+ * only moderators can change it */
+func (lobby *Lobby) Topic(client *Client, args string) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil {
+		client.Error(ERROR_JOIN)
+		return
+	}
+	if args == "" {
+		chatRoom.SendTopic(client)
+		return
+	}
+	if !chatRoom.Moderator(client) {
+		client.Error(ERROR_TOPIC)
+		log.Println("client tried to change the topic without being a moderator")
+		return
+	}
+	topic, description := args, ""
+	if i := strings.Index(args, "|"); i >= 0 {
+		topic, description = strings.TrimSpace(args[:i]), strings.TrimSpace(args[i+1:])
+	}
+	chatRoom.topic, chatRoom.description = topic, description
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_TOPIC, Room: chatRoom.name, Topic: topic, Description: description})
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_TOPIC, client.Name(), topic)))
+	log.Println("client changed the topic")
+}
+
+// makes the current room read-only, or lets everyone post again. moderators only
+func (lobby *Lobby) ReadOnly(client *Client) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !chatRoom.Moderator(client) {
+		client.Error(ERROR_MODERATOR)
+		log.Println("client tried to make a chat room read-only without being a moderator")
+		return
+	}
+	chatRoom.readOnly = !chatRoom.readOnly
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_READONLY, Room: chatRoom.name, ReadOnly: chatRoom.readOnly})
+	if chatRoom.readOnly {
+		chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_READ_ONLY, client.Name())))
+	} else {
+		chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_WRITABLE, client.Name())))
+	}
+	log.Println("client changed whether a chat room is read-only")
+}
+
+// makes the named member of the creator's current room a moderator, announcers can in theirs
+func (lobby *Lobby) Op(client *Client, name string) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !(chatRoom.OwnedBy(client) || chatRoom.Announcer(client)) {
+		client.Error(ERROR_OWNER)
+		return
+	}
+	target := lobby.FindClient(name)
+	if target == nil || !chatRoom.Present(target) {
+		client.Error(fmt.Sprintf(ERROR_NOT_MEMBER, name))
+		return
+	}
+	lobby.AddModerator(chatRoom, target)
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_OP, target.Name())))
+	log.Println("client made a moderator")
+}
+
+/* finds the member of the moderator's room that a moderation command is
+ * aimed at. sends the error and returns nil if they cant be moderated */
+func (lobby *Lobby) Moderate(client *Client, name string) *Client {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !chatRoom.Moderator(client) {
+		client.Error(ERROR_MODERATOR)
+		log.Println("client tried to moderate without being a moderator")
+		return nil
+	}
+	target := lobby.FindClient(name)
+	if target == nil || !chatRoom.Present(target) {
+		client.Error(fmt.Sprintf(ERROR_NOT_MEMBER, name))
+		return nil
+	}
+	if chatRoom.Moderator(target) && !chatRoom.OwnedBy(client) {
+		client.Error(ERROR_PROTECTED)
+		return nil
+	}
+	return target
+}
+
+// removes a member from the moderator's room, they can come back
+func (lobby *Lobby) Kick(client *Client, name string) {
+	target := lobby.Moderate(client, name)
+	if target == nil {
+		return
+	}
+	chatRoom := client.chatRoom
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_KICK, target.Name(), client.Name())))
+	chatRoom.Remove(target, client)
+	log.Println("client kicked someone")
+}
+
+/* bans a name from the moderator's room until it is deleted, and the
+ * address they are connected from too if asked, which locks out everyone
+ * else there. kicks them if they are in it */
+func (lobby *Lobby) Ban(client *Client, name string, withHost bool) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !chatRoom.Moderator(client) {
+		client.Error(ERROR_MODERATOR)
+		log.Println("client tried to ban without being a moderator")
+		return
+	}
+	// checked by name as well, the target may not be online to look up
+	target := lobby.FindClient(name)
+	if name == chatRoom.owner || chatRoom.OwnedBy(target) ||
+		(chatRoom.moderators[name] || chatRoom.Moderator(target)) && !chatRoom.OwnedBy(client) {
+		client.Error(ERROR_PROTECTED)
+		return
+	}
+	host := ""
+	if target != nil && withHost {
+		host = target.Host()
+	}
+	chatRoom.bans[name] = host
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_BAN, Room: chatRoom.name, Name: name, Host: host})
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_BAN, name, client.Name())))
+	delete(chatRoom.members, name)
+	delete(chatRoom.moderators, name)
+	if target != nil {
+		delete(chatRoom.members, target.Identity())
+		delete(chatRoom.moderators, target.Identity())
+		if chatRoom.Present(target) {
+			chatRoom.Remove(target, client)
+		}
+	}
+	log.Println("client banned someone")
+}
+
+// lifts a ban on a name and the address that went with it
+func (lobby *Lobby) Unban(client *Client, name string) {
+	chatRoom := client.chatRoom
+	if chatRoom == nil || !chatRoom.Moderator(client) {
+		client.Error(ERROR_MODERATOR)
+		return
+	}
+	if _, ok := chatRoom.bans[name]; !ok {
+		client.Error(fmt.Sprintf(ERROR_NOT_BANNED, name))
+		return
+	}
+	delete(chatRoom.bans, name)
+	lobby.journal.Append(&JournalEntry{Op: JOURNAL_UNBAN, Room: chatRoom.name, Name: name})
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_UNBAN, name, client.Name())))
+	log.Println("client unbanned someone")
+}
+
+// stops a member from sending messages to the room for a while, like "10m"
+func (lobby *Lobby) MuteMember(client *Client, args string) {
+	name, length := SplitArgs(args)
+	duration, err := time.ParseDuration(length)
+	if err != nil || duration <= 0 {
+		client.Error(ERROR_MUTE)
+		return
+	}
+	target := lobby.Moderate(client, name)
+	if target == nil {
+		return
+	}
+	chatRoom := client.chatRoom
+	lobby.Mute(chatRoom, target, duration)
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_MUTE, target.Name(), duration, client.Name())))
+	log.Println("client muted someone")
+}
+
+// mutes an identity in the room for duration, replacing any mute they already had
+func (lobby *Lobby) Silence(chatRoom *ChatRoom, identity string, duration time.Duration) {
+	if entry := chatRoom.muted[identity]; entry != nil {
+		lobby.scheduler.Cancel(entry)
+	}
+	chatRoom.muted[identity] = lobby.scheduler.After(duration, func() {
+		delete(chatRoom.muted, identity)
+		chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_UNMUTE, identity)))
+	})
+}
+
+// the room with that name if the client is in it, nil otherwise
+func (client *Client) Room(name string) *ChatRoom {
+	for _, chatRoom := range client.chatRooms {
+		if chatRoom.name == name {
+			return chatRoom
+		}
+	}
+	return nil
+}
+
+/* drops a room from the client's rooms. if it was the active one, the
+ * room they joined most recently becomes active */
+func (client *Client) Forget(chatRoom *ChatRoom) {
+	for i, other := range client.chatRooms {
+		if other == chatRoom {
+			client.chatRooms = append(client.chatRooms[:i], client.chatRooms[i+1:]...)
+			break
+		}
+	}
+	if client.chatRoom != chatRoom {
+		return
+	}
+	client.chatRoom = nil
+	if len(client.chatRooms) > 0 {
+		client.chatRoom = client.chatRooms[len(client.chatRooms)-1]
+	}
+}
+
+// finds a connected client by name, nil if there isnt one
+func (lobby *Lobby) FindClient(name string) *Client {
+	for _, client := range lobby.clients {
+		if client.Name() == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// the address the client connected from, without the port
+func (client *Client) Host() string {
+	addr := client.conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/* joins a chat room (if it exists, warning otherwise). 
+ * could have it create that room if it didnt exist and then join,
+ * but then people could join rooms by mistake that are likely empty
+ * example /j genral instead of /j general. instead they are told about
+ * rooms with similar names and can join the closest with /y */
+func (lobby *Lobby) JoinChatRoom(client *Client, name string, password string) {
+	client.suggestion = ""
+	if lobby.chatRooms[name] == nil {
+		suggestions := lobby.Suggest(client, name)
+		if len(suggestions) == 0 {
+			client.Error(ERROR_JOIN)
+		} else {
+			client.suggestion = suggestions[0]
+			client.Error(fmt.Sprintf(ERROR_SUGGEST, QuoteList(suggestions), suggestions[0]))
+		}
+		log.Println("client tried to join a chat room that does not exist")
+		return
+	}
+	refusal := lobby.chatRooms[name].Admit(client)
+	if refusal == ERROR_PASSWORD && password != "" {
+		lobby.CheckRoomPassword(client, name, password)
+		return
+	}
+	if refusal != "" {
+		client.Error(refusal)
+		log.Println("client was refused entry to a private chat room")
+		return
+	}
+	if lobby.chatRooms[name].Present(client) {
+		lobby.Switch(client, name)
+		return
+	}
+	lobby.AddMember(lobby.chatRooms[name], client)
+	lobby.chatRooms[name].Join(client)
+	log.Println("client joined chat room")
+}
+
+// joins the room suggested after the client's last mistyped /j
+func (lobby *Lobby) AcceptSuggestion(client *Client, password string) {
+	if client.suggestion == "" {
+		client.Error(ERROR_NO_SUGGESTION)
+		return
+	}
+	lobby.JoinChatRoom(client, client.suggestion, password)
+}
+
+/* finds rooms the client can see whose names are close to name, closest
+ * first. ignores case, counts prefixes as close, otherwise allows a typo
+ * for short names and one more every TYPO_LETTERS letters */
+func (lobby *Lobby) Suggest(client *Client, name string) []string {
+	type match struct {
+		name     string
+		distance int
+	}
+	want := strings.ToLower(name)
+	matches := make([]match, 0)
+	if want == "" {
+		return nil
+	}
+	typos := (utf8.RuneCountInString(want) + TYPO_LETTERS/2) / TYPO_LETTERS
+	if typos < 1 {
+		typos = 1
+	}
+	for other, chatRoom := range lobby.chatRooms {
+		if !chatRoom.Visible(client) {
+			continue
+		}
+		have := strings.ToLower(other)
+		distance := Levenshtein(want, have)
+		switch {
+		case have == want:
+			distance = 0
+		case strings.HasPrefix(have, want) && distance > 1:
+			distance = 1
+		case distance > typos:
+			continue
+		}
+		matches = append(matches, match{other, distance})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		// then the shortest, "gen" before "general-chat"
+		if len(matches[i].name) != len(matches[j].name) {
+			return len(matches[i].name) < len(matches[j].name)
+		}
+		return matches[i].name < matches[j].name
+	})
+	suggestions := make([]string, 0, MAX_SUGGESTIONS)
+	for i := 0; i < len(matches) && i < MAX_SUGGESTIONS; i++ {
+		suggestions = append(suggestions, matches[i].name)
+	}
+	return suggestions
+}
+
+// number of single character edits between a and b
+func Levenshtein(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = current[j-1] + 1
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(t)]
+}
+
+// "a", "b" or "c"
+func QuoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = "\"" + name + "\""
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
+// leaves the named chat room, or the active one
+func (lobby *Lobby) LeaveChatRoom(client *Client, name string) {
+	chatRoom := client.chatRoom
+	if name != "" {
+		chatRoom = client.Room(name)
+		if chatRoom == nil {
+			client.Error(fmt.Sprintf(ERROR_NOT_IN, name))
+			return
+		}
+	}
+	if chatRoom == nil {
+		client.Error(ERROR_LEAVE)
+		log.Println("client tried to leave the lobby")
+		return
+	}
+	chatRoom.Leave(client)
+	if client.chatRoom != nil && client.chatRoom != chatRoom {
+		client.Notice(fmt.Sprintf(NOTICE_SWITCH, client.chatRoom.name))
+	}
+	log.Println("client left chat room")
+}
+
+/* picks which of the client's rooms plain text goes to. without a name
+ * it tells them which rooms they are in */
+func (lobby *Lobby) Switch(client *Client, name string) {
+	if name == "" {
+		if len(client.chatRooms) == 0 {
+			client.Notice(NOTICE_NO_ROOMS)
+			return
+		}
+		names := make([]string, len(client.chatRooms))
+		for i, chatRoom := range client.chatRooms {
+			names[i] = "\"" + chatRoom.name + "\""
+		}
+		if client.chatRoom == nil {
+			client.Notice(fmt.Sprintf(NOTICE_ROOMS_IDLE, strings.Join(names, ", ")))
+			return
+		}
+		client.Notice(fmt.Sprintf(NOTICE_ROOMS, strings.Join(names, ", "), client.chatRoom.name))
+		return
+	}
+	chatRoom := client.Room(name)
+	if chatRoom == nil {
+		client.Error(fmt.Sprintf(ERROR_NOT_IN, name))
+		return
+	}
+	client.chatRoom = chatRoom
+	client.Notice(fmt.Sprintf(NOTICE_SWITCH, name))
+	log.Println("client switched chat room")
+}
+
+// lists currently open chat rooms
+func (lobby *Lobby) ListChatRooms(client *Client, args []string) {
+	order, pattern := LIST_SORT_NAME, "*"
+	for _, arg := range args {
+		switch arg {
+		case LIST_SORT_NAME, LIST_SORT_ACTIVE, LIST_SORT_SIZE:
+			order = arg
+		default:
+			pattern = arg
+		}
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		client.Error(fmt.Sprintf(ERROR_LIST_PATTERN, pattern))
+		return
+	}
+
+	chatRooms := make([]*ChatRoom, 0, len(lobby.chatRooms))
+	for name, chatRoom := range lobby.chatRooms {
+		if matched, _ := filepath.Match(pattern, name); matched && chatRoom.Visible(client) {
+			chatRooms = append(chatRooms, chatRoom)
+		}
+	}
+	SortChatRooms(chatRooms, order)
+
+	now := lobby.scheduler.Now()
+	list := "\nChat Rooms:\n"
+	for _, chatRoom := range chatRooms {
+		list += fmt.Sprintf("%s - %d online, active %s, expires in %s", chatRoom.name, len(chatRoom.clients),
+			chatRoom.LastActive().Format(LIST_TIME_FORMAT), FormatDuration(chatRoom.expiry.Sub(now)))
+		if chatRoom.readOnly {
+			list += ", read-only"
+		}
+		if chatRoom.topic != "" {
+			list += " - " + chatRoom.topic
+		}
+		list += "\n"
+	}
+	if len(chatRooms) == 0 {
+		list += "none\n"
+	}
+	client.Info(list)
+	log.Println("client listed chat rooms")
+}
+
+/* orders rooms for /l: by name, most recently active first, or most
+ * occupants first. ties go by name so the list doesnt shuffle */
+func SortChatRooms(chatRooms []*ChatRoom, order string) {
+	sort.Slice(chatRooms, func(i, j int) bool {
+		a, b := chatRooms[i], chatRooms[j]
+		switch {
+		case order == LIST_SORT_ACTIVE && !a.expiry.Equal(b.expiry):
+			return a.expiry.After(b.expiry)
+		case order == LIST_SORT_SIZE && len(a.clients) != len(b.clients):
+			return len(a.clients) > len(b.clients)
+		}
+		return a.name < b.name
+	})
+}
+
+// a short, rounded duration like "6d 23h", "5m" or "30s"
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd %dh", int(d.Hours())/24, int(d.Hours())%24)
+}
+
+// creates a new chat room, sets expiration date. messages go to the lobby's journal
+func NewChatRoom(name string, lobby *Lobby) *ChatRoom {
+	return &ChatRoom{
+		name:     name,
+		clients:  make([]*Client, 0),
+		messages: make([]*Frame, 0),
+		expiry:   lobby.scheduler.Now().Add(EXPIRY_TIME),
+		journal:  lobby.journal,
+		history:  lobby.history,
+		clock:    lobby.scheduler.clock,
+		members:  make(map[string]bool),
+
+		moderators: make(map[string]bool),
+		bans:       make(map[string]string),
+		muted:      make(map[string]*ScheduleEntry),
+	}
+}
+
+// the creator and anyone they promoted
+func (chatRoom *ChatRoom) Moderator(client *Client) bool {
+	return client != nil && (chatRoom.OwnedBy(client) || chatRoom.moderators[client.Identity()] || chatRoom.Announcer(client))
+}
+
+/* whether config.json lets the client moderate the announcements room. read
+ * every time rather than granted on join, so taking someone out of the
+ * config is enough to stop them */
+func (chatRoom *ChatRoom) Announcer(client *Client) bool {
+	if chatRoom.announcers == nil {
+		return false
+	}
+	for _, account := range chatRoom.announcers.Accounts {
+		if client.account != "" && client.account == account {
+			return true
+		}
+	}
+	for _, host := range chatRoom.announcers.Hosts {
+		if client.Host() == host {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the client created the room
+func (chatRoom *ChatRoom) OwnedBy(client *Client) bool {
+	return client != nil && chatRoom.owner != "" && chatRoom.owner == client.Identity()
+}
+
+// whether the client's name or address is banned
+func (chatRoom *ChatRoom) Banned(client *Client) bool {
+	if _, ok := chatRoom.bans[client.Name()]; ok {
+		return true
+	}
+	host := client.Host()
+	for _, bannedHost := range chatRoom.bans {
+		if bannedHost != "" && bannedHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the client is in the room right now
+func (chatRoom *ChatRoom) Present(client *Client) bool {
+	for _, member := range chatRoom.clients {
+		if member == client {
+			return true
+		}
+	}
+	return false
+}
+
+// private rooms have a password or only let in invited people
+func (chatRoom *ChatRoom) Private() bool {
+	return chatRoom.secret != "" || chatRoom.inviteOnly
+}
+
+// when the room was last created, restored or talked in
+func (chatRoom *ChatRoom) LastActive() time.Time {
+	return chatRoom.expiry.Add(-EXPIRY_TIME)
+}
+
+// whether the client should see the room in /l
+func (chatRoom *ChatRoom) Visible(client *Client) bool {
+	return !chatRoom.Private() || chatRoom.members[client.Identity()]
+}
+
+/* checks whether the client may join, members always can. returns the
+ * error to send them, empty if they are let in. ERROR_PASSWORD means the
+ * room's password would let them in, which is checked off the lobby thread
+ * by CheckRoomPassword since hashing it is slow */
+func (chatRoom *ChatRoom) Admit(client *Client) string {
+	switch {
+	case chatRoom.Banned(client) && !chatRoom.Moderator(client):
+		return ERROR_BANNED
+	case chatRoom.members[client.Identity()]:
+		return ""
+	case chatRoom.inviteOnly:
+		return ERROR_INVITE_ONLY
+	case chatRoom.secret != "":
+		return ERROR_PASSWORD
+	}
+	return ""
+}
+
+
+// checks for prefix commands first, otherwise sends a message 
+func (lobby *Lobby) Parse(message *Message) {
+	if message.client.Protocol() == PROTO_IRC {
+		lobby.ParseIRC(message)
+		return
+	}
+	switch {
+	default:
+		lobby.SendMessage(message)
+	case message.raw:
+		lobby.SendMessage(message)
+	case strings.HasPrefix(message.text, CMD_REGISTER):
+		name, password := SplitArgs(strings.TrimPrefix(message.text, CMD_REGISTER))
+		lobby.Register(message.client, name, password)
+	case strings.HasPrefix(message.text, CMD_LOGIN):
+		name, password := SplitArgs(strings.TrimPrefix(message.text, CMD_LOGIN))
+		lobby.Login(message.client, name, password)
+	case strings.HasPrefix(message.text, CMD_CREATE):
+		name, password := SplitArgs(strings.TrimPrefix(message.text, CMD_CREATE))
+		lobby.CreateChatRoom(message.client, name, password)
+	case strings.HasPrefix(message.text, CMD_LEAVE):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_LEAVE))
+		lobby.LeaveChatRoom(message.client, name)
+	case strings.HasPrefix(message.text, CMD_WHOIS):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_WHOIS))
+		lobby.Whois(message.client, name)
+	case strings.HasPrefix(message.text, CMD_WHO):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_WHO))
+		lobby.Who(message.client, name)
+	case strings.HasPrefix(message.text, CMD_SWITCH):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_SWITCH))
+		lobby.Switch(message.client, name)
+	case strings.HasPrefix(message.text, CMD_W):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_W))
+		lobby.Switch(message.client, name)
+	case strings.HasPrefix(message.text, CMD_LIST):
+		lobby.ListChatRooms(message.client, strings.Fields(strings.TrimPrefix(message.text, CMD_LIST)))
+	case strings.HasPrefix(message.text, CMD_JOIN):
+		name, password := SplitArgs(strings.TrimPrefix(message.text, CMD_JOIN))
+		lobby.JoinChatRoom(message.client, name, password)
+	case strings.HasPrefix(message.text, CMD_INVITE):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_INVITE))
+		lobby.Invite(message.client, name)
+	case strings.HasPrefix(message.text, CMD_OP):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_OP))
+		lobby.Op(message.client, name)
+	case strings.HasPrefix(message.text, CMD_KICK):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_KICK))
+		lobby.Kick(message.client, name)
+	case strings.HasPrefix(message.text, CMD_BAN):
+		name, rest := SplitArgs(strings.TrimPrefix(message.text, CMD_BAN))
+		lobby.Ban(message.client, name, rest == BAN_HOST)
+	case strings.HasPrefix(message.text, CMD_UNBAN):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_UNBAN))
+		lobby.Unban(message.client, name)
+	case strings.HasPrefix(message.text, CMD_ARCHIVES):
+		lobby.ListArchives(message.client)
+	case strings.HasPrefix(message.text, CMD_READONLY):
+		lobby.ReadOnly(message.client)
+	case strings.HasPrefix(message.text, CMD_RESUME):
+		token, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_RESUME))
+		lobby.Resume(message.client, token)
+	case strings.HasPrefix(message.text, CMD_AWAY):
+		lobby.Away(message.client, strings.TrimSpace(strings.TrimPrefix(message.text, CMD_AWAY)))
+	case strings.HasPrefix(message.text, CMD_BACK):
+		lobby.Back(message.client)
+	case strings.HasPrefix(message.text, CMD_MSG):
+		name, text := SplitArgs(strings.TrimPrefix(message.text, CMD_MSG))
+		if name == "" || text == "" {
+			message.client.Error(ERROR_MSG)
+			return
+		}
+		target := lobby.FindClient(name)
+		if target == nil {
+			message.client.Error(fmt.Sprintf(ERROR_NICK, name))
+			return
+		}
+		lobby.SendPrivate(NewMessage(message.time, message.client, text), target)
+	case strings.HasPrefix(message.text, CMD_STATUS):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_STATUS))
+		lobby.Status(message.client, name)
+	case strings.HasPrefix(message.text, CMD_RESTORE):
+		name, _ := SplitArgs(strings.TrimPrefix(message.text, CMD_RESTORE))
+		lobby.RestoreChatRoom(message.client, name)
+	case strings.HasPrefix(message.text, CMD_YES):
+		_, password := SplitArgs(strings.TrimPrefix(message.text, CMD_YES))
+		lobby.AcceptSuggestion(message.client, password)
+	case strings.HasPrefix(message.text, CMD_TOPIC):
+		lobby.Topic(message.client, strings.TrimSpace(strings.TrimPrefix(message.text, CMD_TOPIC)))
+	case strings.HasPrefix(message.text, CMD_MUTE):
+		lobby.MuteMember(message.client, strings.TrimPrefix(message.text, CMD_MUTE))
+	case strings.HasPrefix(message.text, CMD_NAME):
+		name := strings.TrimSuffix(strings.TrimPrefix(message.text, CMD_NAME+" "), "\n")
+		lobby.ChangeName(message.client, name)
+	case strings.HasPrefix(message.text, CMD_HISTORY):
+		lobby.History(message.client, strings.Fields(strings.TrimPrefix(message.text, CMD_HISTORY)))
+	case strings.HasPrefix(message.text, CMD_HELP):
+		lobby.Help(message.client)
+	case strings.HasPrefix(message.text, CMD_QUIT):
+		message.client.quitting = true
+		message.client.Quit()
+	}
+}
+
+// sends message to chat room. error message if in the lobbby
+func (lobby *Lobby) SendMessage(message *Message) {
+	lobby.SendMessageTo(message, message.client.chatRoom)
+}
+
+// sends message to one of the client's rooms
+func (lobby *Lobby) SendMessageTo(message *Message, chatRoom *ChatRoom) {
+	if chatRoom == nil {
+		message.client.Error(ERROR_SEND)
+		log.Println("client tried to send message in lobby")
+		return
+	}
+	if chatRoom.readOnly && !chatRoom.Moderator(message.client) {
+		message.client.Error(fmt.Sprintf(ERROR_READ_ONLY, chatRoom.name))
+		log.Println("client tried to post in a read-only chat room")
+		return
+	}
+	if entry := chatRoom.muted[message.client.Identity()]; entry != nil {
+		left := entry.at.Sub(lobby.scheduler.Now()) + time.Second - 1
+		message.client.Error(fmt.Sprintf(ERROR_MUTED, left/time.Second*time.Second))
+		return
+	}
+	chatRoom.Broadcast(message.Frame())
+	log.Println("client sent message")
+}
+
+/* sends a message to one client rather than a room. it isnt kept, and if
+ * they are away the sender is told why */
+func (lobby *Lobby) SendPrivate(message *Message, target *Client) {
+	client := message.client
+	frame := message.Frame()
+	frame.To = target.Name()
+	target.outgoing <- frame
+	if target != client {
+		client.outgoing <- frame
+	}
+	if target.away != "" {
+		if client.Protocol() == PROTO_IRC {
+			client.IRCReply(IRC_AWAY, frame.To+" :"+target.away)
+		} else {
+			client.Notice(fmt.Sprintf(NOTICE_AWAY_REPLY, frame.To, target.away))
+		}
+	}
+	log.Println("client sent a private message")
+}
+
+// marks the client away, people who message them get the reason back
+func (lobby *Lobby) Away(client *Client, reason string) {
+	if reason == "" {
+		reason = AWAY_REASON
+	}
+	client.away = reason
+	client.Notice(fmt.Sprintf(NOTICE_AWAY, reason))
+	log.Println("client went away")
+}
+
+// clears /away
+func (lobby *Lobby) Back(client *Client) {
+	if client.away == "" {
+		client.Error(ERROR_NOT_AWAY)
+		return
+	}
+	client.away = ""
+	client.Notice(NOTICE_BACK)
+	log.Println("client came back")
+}
+
+// tells the client whether someone, or they themselves, is online, idle or away
+func (lobby *Lobby) Status(client *Client, name string) {
+	target := client
+	if name != "" {
+		target = lobby.FindClient(name)
+		if target == nil {
+			client.Error(fmt.Sprintf(ERROR_NICK, name))
+			return
+		}
+	}
+	now := lobby.scheduler.Now()
+	client.Notice(fmt.Sprintf(NOTICE_STATUS, target.Name(), target.Status(now), FormatDuration(target.Idle(now))))
+}
+
+/* lists who is in a room with their status, the one the client is talking
+ * in without a name. outside any room it lists everyone online */
+func (lobby *Lobby) Who(client *Client, name string) {
+	chatRoom := client.chatRoom
+	if name != "" {
+		chatRoom = lobby.chatRooms[name]
+		if chatRoom == nil || !chatRoom.Visible(client) {
+			client.Error(ERROR_JOIN)
+			return
+		}
+	}
+	clients, who := lobby.clients, "\nOnline:\n"
+	if chatRoom != nil {
+		clients, who = chatRoom.clients, fmt.Sprintf("\nIn \"%s\":\n", chatRoom.name)
+	}
+	clients = append([]*Client(nil), clients...)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name() < clients[j].Name() })
+	now := lobby.scheduler.Now()
+	for _, other := range clients {
+		who += other.Name()
+		if chatRoom != nil && chatRoom.Moderator(other) {
+			who += " (moderator)"
+		}
+		who += fmt.Sprintf(" - %s, idle for %s\n", other.Status(now), FormatDuration(other.Idle(now)))
+	}
+	client.Info(who)
+	log.Println("client listed who is online")
+}
+
+/* tells the client about someone: their status, when they connected, how
+ * long they have been idle and the rooms they are in that the client can
+ * see. their address is only shown to moderators of one of those rooms */
+func (lobby *Lobby) Whois(client *Client, name string) {
+	if name == "" {
+		client.Error(ERROR_WHOIS)
+		return
+	}
+	target := lobby.FindClient(name)
+	if target == nil {
+		client.Error(fmt.Sprintf(ERROR_NICK, name))
+		return
+	}
+	now := lobby.scheduler.Now()
+	whois := fmt.Sprintf("\n%s - %s\n", target.Name(), target.Status(now))
+	if target.account != "" {
+		whois += "Registered name\n"
+	}
+	whois += fmt.Sprintf("Connected: %s, %s ago\n", target.connected.Format(LIST_TIME_FORMAT), FormatDuration(now.Sub(target.connected)))
+	whois += fmt.Sprintf("Idle: %s\n", FormatDuration(target.Idle(now)))
+	if rooms := lobby.RoomsOf(client, target); len(rooms) > 0 {
+		whois += "Rooms: \"" + strings.Join(rooms, "\", \"") + "\"\n"
+	}
+	if lobby.Moderates(client, target) {
+		whois += "Address: " + target.Host() + "\n"
+	}
+	client.Info(whois)
+	log.Println("client looked someone up")
+}
+
+// names of the rooms target is in that the client can see
+func (lobby *Lobby) RoomsOf(client *Client, target *Client) []string {
+	rooms := make([]string, 0, len(target.chatRooms))
+	for _, chatRoom := range target.chatRooms {
+		if chatRoom.Visible(client) {
+			rooms = append(rooms, chatRoom.name)
+		}
+	}
+	return rooms
+}
+
+/* whether the client moderates a room target is in, which lets them see
+ * target's address. not the announcements room, everyone is put in that
+ * one without choosing to be */
+func (lobby *Lobby) Moderates(client *Client, target *Client) bool {
+	if client == target {
+		return true
+	}
+	for _, chatRoom := range target.chatRooms {
+		if chatRoom != lobby.announcements && chatRoom.Moderator(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// the next free guest name, new_user1, new_user2 and so on
+func (lobby *Lobby) GuestName() string {
+	for {
+		lobby.guests++
+		name := CLIENT_NAME + strconv.Itoa(lobby.guests)
+		_, held := lobby.HeldFor(name)
+		if lobby.FindClient(name) == nil && held == nil && lobby.users.accounts[name] == nil {
+			return name
+		}
+	}
+}
+
+/* why the client cant use the name, empty if they can. names are unique
+ * across the lobby, and registered ones need a /login */
+func (lobby *Lobby) CheckName(client *Client, name string) string {
+	switch {
+	case client.certName != "":
+		return ERROR_CERT_NAME
+	case name == "" || strings.ContainsAny(name, " \t"):
+		return ERROR_NAME
+	case lobby.users.accounts[name] != nil && client.account != name:
+		return fmt.Sprintf(ERROR_REGISTERED, name, name)
+	}
+	if other := lobby.FindClient(name); other != nil && other != client {
+		return fmt.Sprintf(ERROR_NAME_IN_USE, name)
+	}
+	if _, held := lobby.HeldFor(name); held != nil {
+		return fmt.Sprintf(ERROR_NAME_IN_USE, name)
+	}
+	return ""
+}
+
+// change user name
+func (lobby *Lobby) ChangeName(client *Client, name string) {
+	if refusal := lobby.CheckName(client, name); refusal != "" {
+		client.Error(refusal)
+		log.Println("client tried to take a name they cant use")
+		return
+	}
+	told := false
+	for _, chatRoom := range client.chatRooms {
+		told = chatRoom.Presence(fmt.Sprintf(NOTICE_ROOM_NAME, client.name, name)) || told
+	}
+	if !told {
+		client.Notice(fmt.Sprintf(NOTICE_ROOM_NAME, client.name, name))
+	}
+	from := client.Identity()
+	client.SetName(name)
+	lobby.Rekey(client, from)
+	log.Println("client changed their name")
+}
+
+/* registers the name for the client and logs them in as it. the name cant
+ * already be registered or used by someone else */
+func (lobby *Lobby) Register(client *Client, name string, password string) {
+	if name == "" || name == CLIENT_NAME || strings.ContainsAny(name, " \t") || len(password) < PASSWORD_MIN_LENGTH {
+		client.Error(ERROR_REGISTER)
+		return
+	}
+	if client.certName != "" {
+		client.Error(ERROR_CERT_NAME)
+		return
+	}
+	if lobby.users.accounts[name] != nil {
+		client.Error(fmt.Sprintf(ERROR_REGISTERED, name, name))
+		return
+	}
+	if other := lobby.FindClient(name); other != nil && other != client {
+		client.Error(fmt.Sprintf(ERROR_NAME_IN_USE, name))
+		return
+	}
+	if !lobby.StartHashing(client) {
+		return
+	}
+	go func() {
+		lobby.hashing <- true
+		account := HashPassword(password)
+		<-lobby.hashing
+		lobby.logins <- &Login{client: client, name: name, register: true, account: account}
+	}()
+}
+
+// checks the password for a registered name, and gives the client the name if it matches
+func (lobby *Lobby) Login(client *Client, name string, password string) {
+	if client.certName != "" {
+		client.Error(ERROR_CERT_NAME)
+		return
+	}
+	if !lobby.StartHashing(client) {
+		return
+	}
+	account := lobby.users.accounts[name]
+	go func() {
+		lobby.hashing <- true
+		ok := false
+		if account == nil {
+			// hash anyway, so unknown names take as long as wrong passwords
+			HashPassword(password)
+		} else {
+			ok = account.Check(password)
+		}
+		<-lobby.hashing
+		lobby.logins <- &Login{client: client, name: name, ok: ok}
+	}()
+}
+
+/* whether the client can have a password hashed now. they wait for the one
+ * they already sent, and their address waits out its backoff */
+func (lobby *Lobby) StartHashing(client *Client) bool {
+	if client.hashing {
+		client.Error(ERROR_LOGIN_BUSY)
+		return false
+	}
+	if failures := lobby.failedLogins[client.Host()]; failures != nil {
+		if left := failures.until.Sub(lobby.scheduler.Now()); left > 0 {
+			client.Error(fmt.Sprintf(ERROR_LOGIN_WAIT, left.Round(time.Second)))
+			log.Println("client tried to log in during their backoff")
+			return false
+		}
+	}
+	client.hashing = true
+	return true
+}
+
+// makes the client's address wait twice as long as last time before trying again
+func (lobby *Lobby) FailedLogin(client *Client) {
+	host := client.Host()
+	failures := lobby.failedLogins[host]
+	if failures == nil {
+		failures = &LoginFailures{}
+		lobby.failedLogins[host] = failures
+	} else {
+		lobby.scheduler.Cancel(failures.forget)
+	}
+	backoff := LOGIN_BACKOFF_MAX
+	if failures.count < 20 {
+		backoff = LOGIN_BACKOFF << uint(failures.count)
+		if backoff > LOGIN_BACKOFF_MAX {
+			backoff = LOGIN_BACKOFF_MAX
+		}
+	}
+	failures.count++
+	failures.until = lobby.scheduler.Now().Add(backoff)
+	failures.forget = lobby.scheduler.After(backoff+LOGIN_BACKOFF_MAX, func() {
+		delete(lobby.failedLogins, host)
+	})
+}
+
+/* back on the lobby thread once the password has been hashed. a guest using
+ * the name is moved off it */
+func (lobby *Lobby) FinishLogin(login *Login) {
+	client := login.client
+	client.hashing = false
+	if !lobby.Connected(client) {
+		return
+	}
+	if login.room != "" {
+		lobby.FinishRoomPassword(login)
+		return
+	}
+	other := lobby.FindClient(login.name)
+	if other != nil && other != client && other.certName != "" && (login.register || login.ok) {
+		// the name comes from their certificate, so they cant be moved off it
+		client.Error(fmt.Sprintf(ERROR_NAME_IN_USE, login.name))
+		return
+	}
+	if login.register {
+		if lobby.users.accounts[login.name] != nil {
+			client.Error(fmt.Sprintf(ERROR_REGISTERED, login.name, login.name))
+			return
+		}
+		lobby.users.accounts[login.name] = login.account
+		if err := lobby.users.Save(); err != nil {
+			log.Println("Error: ", err)
+		}
+		client.Notice(fmt.Sprintf(NOTICE_REGISTERED, login.name, login.name))
+		log.Println("client registered a name")
+	} else if !login.ok {
+		lobby.FailedLogin(client)
+		client.Error(ERROR_LOGIN)
+		log.Println("client failed to log in")
+		return
+	}
+	if token, _ := lobby.HeldFor(login.name); token != "" {
+		// the owner of the name is back, whoever dropped holding it
+		lobby.DropSession(token)
+	}
+	if other != nil && other != client {
+		other.Notice(fmt.Sprintf(NOTICE_RENAMED, login.name))
+		// renamed before losing the account, so they dont take its rooms with them
+		lobby.ChangeName(other, lobby.GuestName())
+		other.account = ""
+	}
+	if client.account == "" {
+		// what they had as a guest is theirs for good now
+		from := client.Identity()
+		client.account = login.name
+		lobby.Rekey(client, from)
+	}
+	client.account = login.name
+	if client.Name() != login.name {
+		lobby.ChangeName(client, login.name)
+	}
+	client.Notice(fmt.Sprintf(NOTICE_LOGGED_IN, login.name))
+	log.Println("client logged in")
+}
+
+// checks a room password on another thread, FinishRoomPassword lets them in
+func (lobby *Lobby) CheckRoomPassword(client *Client, name string, password string) {
+	if !lobby.StartHashing(client) {
+		return
+	}
+	secret := lobby.chatRooms[name].secret
+	go func() {
+		lobby.hashing <- true
+		ok := CheckSecret(secret, password)
+		<-lobby.hashing
+		lobby.logins <- &Login{client: client, room: name, ok: ok}
+	}()
+}
+
+/* back on the lobby thread with a room password hashed or checked. opens
+ * the new room, or lets the client into the one they gave the password for.
+ * a wrong password counts against their address like a wrong /login */
+func (lobby *Lobby) FinishRoomPassword(login *Login) {
+	client := login.client
+	if login.secret != "" {
+		if lobby.chatRooms[login.room] != nil || lobby.archives[login.room] != nil {
+			client.Error(ERROR_CREATE)
+			return
+		}
+		lobby.OpenChatRoom(client, login.room, login.secret)
+		return
+	}
+	chatRoom := lobby.chatRooms[login.room]
+	if chatRoom == nil {
+		client.Error(ERROR_JOIN)
+		return
+	}
+	if !login.ok {
+		lobby.FailedLogin(client)
+		if client.Protocol() == PROTO_IRC {
+			client.IRCReply(IRC_BADCHANNELKEY, "#"+login.room+" :Cannot join channel (+k)")
+		} else {
+			client.Error(ERROR_PASSWORD)
+		}
+		log.Println("client gave the wrong password for a private chat room")
+		return
+	}
+	lobby.AddMember(chatRoom, client)
+	if client.Protocol() == PROTO_IRC {
+		lobby.JoinIRC(client, login.room, "")
+	} else {
+		lobby.JoinChatRoom(client, login.room, "")
+	}
+}
+
+// whether the client is still connected to the lobby
+func (lobby *Lobby) Connected(client *Client) bool {
+	for _, other := range lobby.clients {
+		if other == client {
+			return true
+		}
+	}
+	return false
+}
+
+/* pages back through the current room's backlog. without a before-id it
+ * carries on from the oldest message the client was sent */
+func (lobby *Lobby) History(client *Client, args []string) {
+	if client.chatRoom == nil {
+		client.Error(ERROR_HISTORY)
+		log.Println("client asked for history in the lobby")
+		return
+	}
+	before, n := client.before, lobby.history.Replay
+	if len(args) > 0 {
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			client.Error(ERROR_HISTORY)
+			return
+		}
+		before = id
+	}
+	if len(args) > 1 {
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 1 {
+			client.Error(ERROR_HISTORY)
+			return
+		}
+		n = count
+	}
+	if before == 0 {
+		client.Notice(NOTICE_HISTORY_END)
+		return
+	}
+	client.chatRoom.Replay(client, before, n)
+	log.Println("client requested history")
+}
+
+// sends list of commands
+func (lobby *Lobby) Help(client *Client) {
+	help := "\nCommands:\n"
+	help += CMD_HELP +" - lists all commands\n"
+	help += CMD_LIST + " [dev-*] [name | active | size] - lists chat rooms matching dev-*, sorted by name, last activity or size\n"
+	help += CMD_CREATE + " test [password] - creates a chat room named test, private if given a password (registered names only)\n"
+	help += CMD_JOIN + " test [password] - joins a chat room named test, staying in the others\n"
+	help += CMD_YES + " - joins the chat room suggested after a mistyped " + CMD_JOIN + "\n"
+	help += CMD_INVITE + " name - lets name into your chat room, which becomes invite-only (registered names only)\n"
+	help += CMD_OP + " name - makes name a moderator of your chat room\n"
+	help += CMD_KICK + " name - removes name from the chat room (moderators)\n"
+	help += CMD_BAN + " name [" + BAN_HOST + "] - bans name from the chat room, and with " + BAN_HOST + " everyone on their address (moderators)\n"
+	help += CMD_UNBAN + " name - lifts a ban (moderators)\n"
+	help += CMD_TOPIC + " [topic | description] - shows or sets the topic of the chat room (moderators)\n"
+	help += CMD_READONLY + " - makes the chat room read-only, or lets everyone post again (moderators)\n"
+	help += CMD_MUTE + " name 10m - stops name sending messages for 10 minutes (moderators)\n"
+	help += CMD_ARCHIVES + fmt.Sprintf(" - lists chat rooms archived after going quiet, kept for %d days\n", ARCHIVE_TIME/(24*time.Hour))
+	help += CMD_RESTORE + " test - brings back the archived chat room test with its history (its creator, if it has one)\n"
+	help += CMD_LEAVE + " [test] - leaves test, or the chat room you are talking in\n"
+	help += CMD_SWITCH + " test or " + CMD_W + " test - talks in test, one of the chat rooms you are in\n"
+	help += CMD_NAME + " test - changes your name to test\n"
+	help += CMD_REGISTER + " test password - registers the name test so only you can use it\n"
+	help += CMD_LOGIN + " test password - takes back your registered name test\n"
+	help += CMD_MSG + " name message - sends message to name alone\n"
+	help += CMD_AWAY + " [reason] - marks you away, people who message you are told why\n"
+	help += CMD_BACK + " - marks you back\n"
+	help += CMD_WHO + " [test] - lists who is in test, or the chat room you are talking in, with their status\n"
+	help += CMD_WHOIS + " name - shows when name connected, how long they have been idle and their chat rooms\n"
+	help += CMD_STATUS + " [name] - shows whether name is online, idle or away, and for how long they have been idle\n"
+	help += CMD_RESUME + " token - takes back your name and chat rooms after losing your connection\n"
+	help += CMD_HISTORY + " [before-id] [n] - shows n older messages from the current chat room\n"
+	help += CMD_PROTO + " json 1 - switches to framed JSON output\n"
+	help += CMD_QUIT + " - quits the program\n"
+	client.Info(help)
+	log.Println("client requested help")
+}
+
+// sends all of the previous message upon joining the chat room
+func (chatRoom *ChatRoom) Join(client *Client) {
+	client.chatRoom = chatRoom
+	client.chatRooms = append(client.chatRooms, chatRoom)
+	chatRoom.Replay(client, 0, chatRoom.history.Replay)
+	if (chatRoom.topic != "" || chatRoom.description != "") && client.Protocol() != PROTO_IRC {
+		// irc clients get RPL_TOPIC instead
+		chatRoom.SendTopic(client)
+	}
+	chatRoom.clients = append(chatRoom.clients, client)
+	chatRoom.Presence(fmt.Sprintf(NOTICE_ROOM_JOIN, client.name))
+}
+
+/* tells the room someone joined, left or changed their name. read-only rooms
+ * keep quiet so the announcements arent buried. returns whether it was sent */
+func (chatRoom *ChatRoom) Presence(text string) bool {
+	if chatRoom.readOnly {
+		return false
+	}
+	chatRoom.Broadcast(NewFrame(FRAME_NOTICE, SERVER_NAME, text))
+	return true
+}
+
+/* sends the client the last n messages older than frame id before, 0 for
+ * the newest, and remembers where they got up to */
+func (chatRoom *ChatRoom) Replay(client *Client, before uint64, n int) {
+	end := len(chatRoom.messages)
+	for before != 0 && end > 0 && chatRoom.messages[end-1].Id >= before {
+		end--
+	}
+	start := 0
+	if n > 0 && end > n {
+		start = end - n
+	}
+	if start == end {
+		client.before = 0
+		if before != 0 {
+			client.Notice(NOTICE_HISTORY_END)
+		}
+		return
+	}
+	for _, frame := range chatRoom.messages[start:end] {
+		client.outgoing <- frame
+	}
+	client.before = chatRoom.messages[start].Id
+	if start > 0 {
+		client.Notice(fmt.Sprintf(NOTICE_HISTORY_MORE, start))
+	}
+}
+
+// sends the client every message newer than frame id after
+func (chatRoom *ChatRoom) ReplaySince(client *Client, after uint64) {
+	for _, frame := range chatRoom.messages {
+		if frame.Id > after {
+			client.outgoing <- frame
+		}
+	}
+}
+
+// adds a frame to the backlog, dropping the oldest ones past the limits
+func (chatRoom *ChatRoom) Record(frame *Frame) {
+	chatRoom.messages = append(chatRoom.messages, frame)
+	chatRoom.bytes += len(frame.Payload)
+	history := chatRoom.history
+	for len(chatRoom.messages) > 1 &&
+		((history.MaxMessages > 0 && len(chatRoom.messages) > history.MaxMessages) ||
+			(history.MaxBytes > 0 && chatRoom.bytes > history.MaxBytes)) {
+		chatRoom.bytes -= len(chatRoom.messages[0].Payload)
+		chatRoom.messages[0] = nil
+		chatRoom.messages = chatRoom.messages[1:]
+	}
+}
+
+// tells the client the topic and description
+func (chatRoom *ChatRoom) SendTopic(client *Client) {
+	if chatRoom.topic == "" && chatRoom.description == "" {
+		client.Notice(NOTICE_NO_TOPIC)
+		return
+	}
+	if chatRoom.topic != "" {
+		client.Notice(fmt.Sprintf(NOTICE_TOPIC, chatRoom.topic))
+	}
+	if chatRoom.description != "" {
+		client.Notice(fmt.Sprintf(NOTICE_DESCRIPTION, chatRoom.description))
+	}
+}
+
+// takes a member out of the room on a moderator's say so
+func (chatRoom *ChatRoom) Remove(client *Client, moderator *Client) {
+	chatRoom.Leave(client)
+	if client.Protocol() == PROTO_IRC {
+		client.Raw(fmt.Sprintf(":%s!%s@%s KICK #%s %s :Kicked", moderator.Name(), moderator.Name(), IRC_SERVER, chatRoom.name, client.Name()))
+	} else {
+		client.Notice(fmt.Sprintf(NOTICE_KICKED, chatRoom.name))
+	}
+}
+
+// Removes client from chat room.
+func (chatRoom *ChatRoom) Leave(client *Client) {
+	chatRoom.Presence(fmt.Sprintf(NOTICE_ROOM_LEAVE, client.name))
+	for i, otherClient := range chatRoom.clients {
+		if client == otherClient {
+			chatRoom.clients = append(chatRoom.clients[:i], chatRoom.clients[i+1:]...)
+			break
+		}
+	}
+	client.Forget(chatRoom)
+}
+
+// sends the current chatroom the message, tagged with the room name
+func (chatRoom *ChatRoom) Broadcast(frame *Frame) {
+	frame.Room = chatRoom.name
+	chatRoom.expiry = chatRoom.clock.Now().Add(EXPIRY_TIME)
+	chatRoom.Record(frame)
+	chatRoom.journal.Append(&JournalEntry{Op: JOURNAL_MESSAGE, Room: chatRoom.name, Frame: frame})
+	for _, client := range chatRoom.clients {
+		client.outgoing <- frame
+	}
+}
+
+// Notifies the clients within the chat room that it is being archived, and kicks
+// them back into the lobby. The history stays with the room.
+func (chatRoom *ChatRoom) Archive() {
+	chatRoom.Notify(NewFrame(FRAME_NOTICE, SERVER_NAME, fmt.Sprintf(NOTICE_ROOM_DELETE, chatRoom.name)))
+	for _, client := range chatRoom.clients {
+		client.Forget(chatRoom)
+	}
+	chatRoom.clients = make([]*Client, 0)
+}
+
+// sends the occupants a frame without keeping it or counting it as activity
+func (chatRoom *ChatRoom) Notify(frame *Frame) {
+	frame.Room = chatRoom.name
+	for _, client := range chatRoom.clients {
+		client.outgoing <- frame
+	}
+}
+
+
+
+// creates a new client speaking the given protocol, opens reader/writer for them.
+func NewClient(conn net.Conn, protocol int) *Client {
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(conn)
+
+	client := &Client{
+		name:     CLIENT_NAME,
+		chatRoom: nil,
+		incoming: make(chan *Message),
+		outgoing: make(chan *Frame),
+		conn:     conn,
+		reader:   reader,
+		writer:   writer,
+		protocol: protocol,
+		done:     make(chan bool),
+		lastRead: time.Now(),
+	}
+	client.connected = client.lastRead
+
+	client.Listen()
+	return client
+}
+
+// creates two threads to read and write
+func (client *Client) Listen() {
+	go client.Read()
+	go client.Write()
+}
+
+/* reads string from client, formats into message or returns error. 
+ * sends it back to client. framed clients send one JSON frame per line */
+func (client *Client) Read() {
+	for {
+		str, err := client.reader.ReadString('\n')
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		message := NewMessage(time.Now(), client, strings.TrimSuffix(str, "\n"))
+		switch client.Protocol() {
+		case PROTO_IRC:
+			message.text = strings.TrimSuffix(message.text, "\r")
+			switch NewIRCCommand(message.text).command {
+			case "", "PING", "PONG":
+				// keepalives the irc client sends by itself
+			default:
+				client.Active(message.time)
+			}
+			client.incoming <- message
+			continue
+		case PROTO_JSON:
+			var frame Frame
+			if json.Unmarshal([]byte(message.text), &frame) != nil || (frame.Type != FRAME_MSG && frame.Type != FRAME_CMD) {
+				client.Error(ERROR_FRAME)
+				log.Println("client sent a malformed frame")
+				continue
+			}
+			message.text = frame.Payload
+			message.raw = frame.Type == FRAME_MSG
+		}
+		if !message.raw && strings.HasPrefix(message.text, CMD_PROTO) {
+			client.Negotiate(strings.Fields(strings.TrimPrefix(message.text, CMD_PROTO)))
+			continue
+		}
+		if strings.TrimSpace(message.text) != "" {
+			client.Active(message.time)
+		}
+		client.incoming <- message
+	}
+	close(client.incoming)
+	log.Println("Closed client's incoming channel read thread")
+}
+
+/* switches the wire protocol, "/proto json 1" or "/proto plain".
+ * the reply is the first frame sent in the new protocol */
+func (client *Client) Negotiate(args []string) {
+	switch {
+	case len(args) == 1 && args[0] == PROTO_NAME_PLAIN:
+		client.SetProtocol(PROTO_PLAIN)
+		client.outgoing <- NewFrame(FRAME_HELLO, SERVER_NAME, PROTO_NAME_PLAIN)
+	case len(args) >= 1 && args[0] == PROTO_NAME_JSON:
+		version := PROTO_VERSION
+		if len(args) > 1 {
+			requested, err := strconv.Atoi(args[1])
+			if err != nil || requested < 1 {
+				client.Error(ERROR_PROTO)
+				return
+			}
+			// answer with the highest version both sides speak
+			if requested < version {
+				version = requested
+			}
+		}
+		client.SetProtocol(PROTO_JSON)
+		client.outgoing <- NewFrame(FRAME_HELLO, SERVER_NAME, fmt.Sprintf("%s %d", PROTO_NAME_JSON, version))
+	default:
+		client.Error(ERROR_PROTO)
+		return
+	}
+	log.Println("client negotiated protocol", args)
+}
+
+// returns the wire protocol the client is currently speaking
+func (client *Client) Protocol() int {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.protocol
+}
+
+// returns the clients name, safe to call from the write thread
+func (client *Client) Name() string {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.name
+}
+
+// changes the clients name, only called from the lobby thread
+func (client *Client) SetName(name string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.name = name
+}
+
+// changes the wire protocol used for subsequent reads and writes
+func (client *Client) SetProtocol(protocol int) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.protocol = protocol
+}
+
+// the USER an irc client gave, other clients just go by their name
+func (client *Client) IRCUser() string {
+	if client.ircUser != "" {
+		return client.ircUser
+	}
+	return client.Name()
+}
+
+/* notes that the client sent a command or message, which isnt idle. only
+ * called for what they typed, not keepalives or protocol negotiation */
+func (client *Client) Active(at time.Time) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.lastRead = at
+}
+
+// when the client last sent a command or message
+func (client *Client) LastRead() time.Time {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.lastRead
+}
+
+// how long since the client last sent anything
+func (client *Client) Idle(now time.Time) time.Duration {
+	if idle := now.Sub(client.LastRead()); idle > 0 {
+		return idle
+	}
+	return 0
+}
+
+// STATUS_AWAY with the reason if they are away, otherwise idle or online
+func (client *Client) Status(now time.Time) string {
+	switch {
+	case client.away != "":
+		return fmt.Sprintf(STATUS_AWAY, client.away)
+	case client.Idle(now) >= IDLE_TIME:
+		return STATUS_IDLE
+	}
+	return STATUS_ONLINE
+}
+
+// queues a server notice for the client
+func (client *Client) Notice(text string) {
+	client.outgoing <- NewFrame(FRAME_NOTICE, SERVER_NAME, text)
+}
+
+// queues a server error for the client
+func (client *Client) Error(text string) {
+	client.outgoing <- NewFrame(FRAME_ERROR, SERVER_NAME, text)
+}
+
+// queues a listing or help text for the client
+func (client *Client) Info(text string) {
+	client.outgoing <- NewFrame(FRAME_INFO, SERVER_NAME, text)
+}
+
+// queues a preformatted irc line, "NUMERIC params" gets the server prefix
+func (client *Client) Raw(line string) {
+	client.outgoing <- NewFrame(FRAME_RAW, SERVER_NAME, line)
+}
+
+// renders a frame in the client's protocol
+func (client *Client) Encode(frame *Frame) (string, error) {
+	switch client.Protocol() {
+	case PROTO_IRC:
+		return client.EncodeIRC(frame), nil
+	case PROTO_JSON:
+		data, err := json.Marshal(frame)
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	}
+	return frame.String(), nil
+}
+
+/* renders a frame as irc lines. chat lines become PRIVMSG from the sender,
+ * everything else the server says becomes one NOTICE per line */
+func (client *Client) EncodeIRC(frame *Frame) string {
+	nick := client.Name()
+	switch frame.Type {
+	case FRAME_RAW:
+		return frame.Payload + "\r\n"
+	case FRAME_HELLO:
+		return ""
+	case FRAME_MSG:
+		if frame.from == client {
+			return ""
+		}
+		if frame.To != "" {
+			return fmt.Sprintf(":%s!%s@%s PRIVMSG %s :%s\r\n", frame.Sender, frame.Sender, IRC_SERVER, frame.To, frame.Payload)
+		}
+		return fmt.Sprintf(":%s!%s@%s PRIVMSG #%s :%s\r\n", frame.Sender, frame.Sender, IRC_SERVER, frame.Room, frame.Payload)
+	}
+	target := nick
+	if frame.Room != "" {
+		target = "#" + frame.Room
+	}
+	str := ""
+	for _, line := range strings.Split(frame.Payload, "\n") {
+		if line != "" {
+			str += fmt.Sprintf(":%s NOTICE %s :%s\r\n", IRC_SERVER, target, line)
+		}
+	}
+	return str
+}
+
+// reads message from outgoing, writes to socket
+func (client *Client) Write() {
+	for frame := range client.outgoing {
+		str, err := client.Encode(frame)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		_, err = client.writer.WriteString(str)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		err = client.writer.Flush()
+		if err != nil {
+			log.Println(err)
+			break
+		}
+	}
+	close(client.done)
+	log.Println("Closed client's write thread")
+}
+
+// close clients connection
+func (client *Client) Quit() {
+	client.conn.Close()
+}
+
+// wraps a websocket so it can be used as a client connection
+func NewWSConn(ws *websocket.Conn) *WSConn {
+	return &WSConn{Conn: ws}
+}
+
+// returns the next message (newline terminated) one chunk at a time
+func (conn *WSConn) Read(data []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		var str string
+		err := websocket.Message.Receive(conn.Conn, &str)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasSuffix(str, "\n") {
+			str += "\n"
+		}
+		conn.pending = []byte(str)
+	}
+	n := copy(data, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// the websocket package reports the origin, use the peer of the request instead
+func (conn *WSConn) RemoteAddr() net.Addr {
+	return WSAddr(conn.Request().RemoteAddr)
+}
+
+func (addr WSAddr) Network() string { return "websocket" }
+func (addr WSAddr) String() string  { return string(addr) }
+
+/* joins websocket clients to the lobby, they share the rooms and broadcasts
+ * of the tcp clients. the connection is closed when the handler returns, so
+ * wait until everything queued for the client has been written */
+func (lobby *Lobby) ServeWS(ws *websocket.Conn) {
+	client := NewClient(NewWSConn(ws), PROTO_PLAIN)
+	if state := ws.Request().TLS; state != nil && len(state.PeerCertificates) > 0 {
+		client.certName = state.PeerCertificates[0].Subject.CommonName
+		client.SetName(client.certName)
+	}
+	lobby.join <- client
+	<-client.done
+	log.Println("websocket client disconnected")
+}
+
+
+/* wraps a connection in telnet handling. active connections offer to echo
+ * and suppress go-ahead, and ask for the window size straight away */
+func NewTelnetConn(conn net.Conn, active bool) *TelnetConn {
+	telnetConn := &TelnetConn{
+		Conn:     conn,
+		buf:      make([]byte, 1024),
+		sentWill: make(map[byte]bool),
+		sentDo:   make(map[byte]bool),
+		telnet:   active,
+	}
+	if active {
+		telnetConn.negotiate(TELNET_WILL, TELNET_ECHO)
+		telnetConn.negotiate(TELNET_WILL, TELNET_SGA)
+		telnetConn.negotiate(TELNET_DO, TELNET_NAWS)
+	}
+	return telnetConn
+}
+
+// returns clean, newline terminated lines
+func (conn *TelnetConn) Read(data []byte) (int, error) {
+	for len(conn.pending) == 0 {
+		n, err := conn.Conn.Read(conn.buf)
+		if err != nil {
+			return 0, err
+		}
+		for _, b := range conn.buf[:n] {
+			conn.parse(b)
+		}
+	}
+	n := copy(data, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// feeds one byte through the telnet state machine
+func (conn *TelnetConn) parse(b byte) {
+	switch conn.state {
+	case TELNET_STATE_IAC:
+		conn.state = TELNET_STATE_DATA
+		switch b {
+		case TELNET_IAC:
+			conn.input(b)
+		case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+			conn.verb = b
+			conn.state = TELNET_STATE_OPTION
+		case TELNET_SB:
+			conn.sb = conn.sb[:0]
+			conn.state = TELNET_STATE_SB
+		case TELNET_EC:
+			conn.erase()
+		case TELNET_EL:
+			for conn.erase() {
+			}
+		}
+		// anything else (NOP, GA, AYT...) is ignored
+	case TELNET_STATE_OPTION:
+		conn.state = TELNET_STATE_DATA
+		conn.option(conn.verb, b)
+	case TELNET_STATE_SB:
+		if b == TELNET_IAC {
+			conn.state = TELNET_STATE_SB_IAC
+		} else {
+			conn.sb = append(conn.sb, b)
+		}
+	case TELNET_STATE_SB_IAC:
+		switch b {
+		case TELNET_SE:
+			conn.state = TELNET_STATE_DATA
+			conn.subnegotiation()
+		case TELNET_IAC:
+			conn.state = TELNET_STATE_SB
+			conn.sb = append(conn.sb, b)
+		default:
+			conn.state = TELNET_STATE_SB
+		}
+	default:
+		if b == TELNET_IAC {
+			conn.mutex.Lock()
+			conn.telnet = true
+			conn.mutex.Unlock()
+			conn.state = TELNET_STATE_IAC
+			return
+		}
+		conn.input(b)
+	}
+}
+
+// handles a typed byte, with line editing
+func (conn *TelnetConn) input(b byte) {
+	sawCR := conn.sawCR
+	conn.sawCR = false
+	switch {
+	case b == '\r':
+		conn.sawCR = true
+		conn.endLine()
+	case b == '\n' || b == 0:
+		if !sawCR && b == '\n' {
+			conn.endLine()
+		}
+	case b == '\b' || b == 127:
+		conn.erase()
+	case b < 32 && b != '\t':
+		// other control characters never make it into messages
+	default:
+		conn.mutex.Lock()
+		conn.line = append(conn.line, b)
+		echo := conn.echo
+		conn.mutex.Unlock()
+		if echo {
+			conn.send([]byte{b})
+		}
+	}
+}
+
+// removes the last character typed (a whole utf-8 sequence), false if the line was empty
+func (conn *TelnetConn) erase() bool {
+	conn.mutex.Lock()
+	if len(conn.line) == 0 {
+		conn.mutex.Unlock()
+		return false
+	}
+	end := len(conn.line) - 1
+	for end > 0 && conn.line[end]&0xC0 == 0x80 {
+		end--
+	}
+	conn.line = conn.line[:end]
+	echo := conn.echo
+	conn.mutex.Unlock()
+	if echo {
+		conn.send([]byte("\b \b"))
+	}
+	return true
+}
+
+// moves the line being typed to pending
+func (conn *TelnetConn) endLine() {
+	conn.mutex.Lock()
+	line := append(conn.line, '\n')
+	conn.line = nil
+	echo := conn.echo
+	conn.mutex.Unlock()
+	if echo {
+		conn.send([]byte("\r\n"))
+	}
+	conn.pending = append(conn.pending, line...)
+}
+
+/* answers WILL/WONT/DO/DONT. we will echo and suppress go-ahead, and want
+ * the window size, everything else is refused. requests we made ourselves
+ * are only acknowledged, so the two ends never loop */
+func (conn *TelnetConn) option(verb byte, option byte) {
+	switch verb {
+	case TELNET_DO:
+		if option != TELNET_ECHO && option != TELNET_SGA {
+			conn.send([]byte{TELNET_IAC, TELNET_WONT, option})
+			return
+		}
+		if option == TELNET_ECHO {
+			conn.mutex.Lock()
+			conn.echo = true
+			conn.mutex.Unlock()
+		}
+		if !conn.sentWill[option] {
+			conn.negotiate(TELNET_WILL, option)
+		}
+	case TELNET_DONT:
+		if option == TELNET_ECHO {
+			conn.mutex.Lock()
+			conn.echo = false
+			conn.mutex.Unlock()
+		}
+		if conn.sentWill[option] {
+			conn.sentWill[option] = false
+			conn.send([]byte{TELNET_IAC, TELNET_WONT, option})
+		}
+	case TELNET_WILL:
+		if option != TELNET_NAWS {
+			conn.send([]byte{TELNET_IAC, TELNET_DONT, option})
+			return
+		}
+		if !conn.sentDo[option] {
+			conn.negotiate(TELNET_DO, option)
+		}
+	case TELNET_WONT:
+		if conn.sentDo[option] {
+			conn.sentDo[option] = false
+			conn.send([]byte{TELNET_IAC, TELNET_DONT, option})
+		}
+	}
+	log.Println("telnet negotiated", verb, option)
+}
+
+// sends WILL or DO and remembers it was our idea
+func (conn *TelnetConn) negotiate(verb byte, option byte) {
+	if verb == TELNET_WILL {
+		conn.sentWill[option] = true
+	} else {
+		conn.sentDo[option] = true
+	}
+	conn.send([]byte{TELNET_IAC, verb, option})
+}
+
+// handles a finished subnegotiation, NAWS is "31 width width height height"
+func (conn *TelnetConn) subnegotiation() {
+	if len(conn.sb) == 5 && conn.sb[0] == TELNET_NAWS {
+		conn.mutex.Lock()
+		conn.width = int(conn.sb[1])<<8 | int(conn.sb[2])
+		conn.mutex.Unlock()
+		log.Println("telnet window width", int(conn.sb[1])<<8|int(conn.sb[2]))
+	}
+}
+
+// returns the width the client reported, 0 if it never did
+func (conn *TelnetConn) Width() int {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.width
+}
+
+// writes straight to the connection, for negotiation and echo
+func (conn *TelnetConn) send(data []byte) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.Conn.Write(data)
+}
+
+/* writes output from the client's write thread. telnet clients get CRLF line
+ * ends, escaped IAC bytes and lines wrapped to their window, and whatever they
+ * were typing is redrawn underneath when the server is echoing */
+func (conn *TelnetConn) Write(data []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if !conn.telnet {
+		return conn.Conn.Write(data)
+	}
+
+	out := make([]byte, 0, len(data)+16)
+	if conn.echo && len(conn.line) > 0 {
+		out = append(out, '\r', '\n')
+		conn.column = 0
+	}
+	for _, b := range data {
+		switch {
+		case b == '\n':
+			out = append(out, '\r', '\n')
+			conn.column = 0
+			continue
+		case b&0xC0 == 0x80:
+			// continuation of a utf-8 character, doesnt take a column
+			out = append(out, b)
+			continue
+		}
+		if conn.width > 0 && conn.column >= conn.width {
+			out = append(out, '\r', '\n')
+			conn.column = 0
+		}
+		if b == TELNET_IAC {
+			out = append(out, TELNET_IAC)
+		}
+		out = append(out, b)
+		conn.column++
+	}
+	if conn.echo && len(conn.line) > 0 {
+		out = append(out, conn.line...)
+		conn.column = len(conn.line)
+	}
+	_, err := conn.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// splits command arguments into the first word and the rest of the line
+func SplitArgs(args string) (string, string) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(fields) < 2 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
+
+// a random resume token, in hex
+func NewToken() string {
+	token := make([]byte, TOKEN_SIZE)
+	if _, err := rand.Read(token); err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	return hex.EncodeToString(token)
+}
+
+/* salts and hashes a room password like an account's, as iterations$salt$hash
+ * with the salt and hash in hex. slow, so not on the lobby thread */
+func HashSecret(password string) string {
+	account := HashPassword(password)
+	return strconv.Itoa(account.Iterations) + "$" + account.Salt + "$" + account.Hash
+}
+
+/* whether the password matches a hash made by HashSecret. journals from
+ * before rooms used PBKDF2 have salt$hash, a single salted SHA-256 */
+func CheckSecret(secret string, password string) bool {
+	parts := strings.Split(secret, "$")
+	switch len(parts) {
+	case 2:
+		salt, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash := sha256.Sum256(append(salt, password...))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(parts[1])) == 1
+	case 3:
+		iterations, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return false
+		}
+		account := &Account{Iterations: iterations, Salt: parts[1], Hash: parts[2]}
+		return account.Check(password)
+	}
+	return false
+}
+
+// reads the user store, a missing file has no one registered yet
+func LoadUsers(path string) (*UserStore, error) {
+	users := &UserStore{path: path, accounts: make(map[string]*Account)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &users.accounts); err != nil {
+		return nil, err
+	}
+	log.Printf("loaded %d registered names from %s\n", len(users.accounts), path)
+	return users, nil
+}
+
+// writes the whole store to a temporary file and renames it over the old one
+func (users *UserStore) Save() error {
+	data, err := json.MarshalIndent(users.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(users.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(users.path+".tmp", users.path)
+}
+
+// salts and hashes an account password, slow enough to make guessing expensive
+func HashPassword(password string) *Account {
+	salt := make([]byte, SECRET_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, PASSWORD_KEY_SIZE)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	return &Account{
+		Salt:       hex.EncodeToString(salt),
+		Hash:       hex.EncodeToString(hash),
+		Iterations: PASSWORD_ITERATIONS,
+		Created:    time.Now(),
+	}
+}
+
+// whether the password matches the account's hash
+func (account *Account) Check(password string) bool {
+	salt, err := hex.DecodeString(account.Salt)
+	if err != nil {
+		return false
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, account.Iterations, PASSWORD_KEY_SIZE)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash)), []byte(account.Hash)) == 1
+}
+
+// tells the scheduler the time, so expiry can be tested without waiting days
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// the real time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time                         { return time.Now() }
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+/* runs functions at given times on the lobby thread, instead of a sleeping
+ * goroutine per room. entries are kept in a heap ordered by time, and only
+ * the earliest one has a timer. not safe to use from other threads.
+ * Evan's Work/util/scheduler.go is the same scheduler for newServer.go,
+ * ken cant import it, so a fix to one belongs in the other */
+type Scheduler struct {
+	clock   Clock
+	entries scheduleHeap
+	wake    <-chan time.Time // fires when the earliest entry is due
+	next    time.Time        // what wake was set for
+	count   uint64
+}
+
+// something to run later, can be cancelled or moved until it has run
+type ScheduleEntry struct {
+	at    time.Time
+	run   func()
+	seq   uint64 // entries due at the same time run in the order they were added
+	index int    // in the heap, -1 once it has run or been cancelled
+}
+
+type scheduleHeap []*ScheduleEntry
+
+func (entries scheduleHeap) Len() int { return len(entries) }
+func (entries scheduleHeap) Less(i, j int) bool {
+	if entries[i].at.Equal(entries[j].at) {
+		return entries[i].seq < entries[j].seq
+	}
+	return entries[i].at.Before(entries[j].at)
+}
+func (entries scheduleHeap) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+	entries[i].index = i
+	entries[j].index = j
+}
+func (entries *scheduleHeap) Push(x interface{}) {
+	entry := x.(*ScheduleEntry)
+	entry.index = len(*entries)
+	*entries = append(*entries, entry)
+}
+func (entries *scheduleHeap) Pop() interface{} {
+	old := *entries
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*entries = old[:len(old)-1]
+	return entry
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{clock: clock, entries: make(scheduleHeap, 0)}
+}
+
+// the scheduler's idea of now
+func (scheduler *Scheduler) Now() time.Time {
+	return scheduler.clock.Now()
+}
+
+// runs fn at the given time
+func (scheduler *Scheduler) At(at time.Time, fn func()) *ScheduleEntry {
+	scheduler.count++
+	entry := &ScheduleEntry{at: at, run: fn, seq: scheduler.count}
+	heap.Push(&scheduler.entries, entry)
+	scheduler.reset()
+	return entry
+}
+
+// runs fn once d has passed
+func (scheduler *Scheduler) After(d time.Duration, fn func()) *ScheduleEntry {
+	return scheduler.At(scheduler.Now().Add(d), fn)
+}
+
+// stops an entry from running, does nothing if it already has
+func (scheduler *Scheduler) Cancel(entry *ScheduleEntry) {
+	if entry == nil || entry.index < 0 {
+		return
+	}
+	heap.Remove(&scheduler.entries, entry.index)
+	scheduler.reset()
+}
+
+// moves an entry to a new time, putting it back if it already ran
+func (scheduler *Scheduler) Reschedule(entry *ScheduleEntry, at time.Time) {
+	entry.at = at
+	if entry.index < 0 {
+		scheduler.count++
+		entry.seq = scheduler.count
+		heap.Push(&scheduler.entries, entry)
+	} else {
+		heap.Fix(&scheduler.entries, entry.index)
+	}
+	scheduler.reset()
+}
+
+// fires when there is something to Run, never if there is nothing scheduled
+func (scheduler *Scheduler) Wake() <-chan time.Time {
+	return scheduler.wake
+}
+
+// runs every entry that is due
+func (scheduler *Scheduler) Run() {
+	scheduler.next = time.Time{}
+	for len(scheduler.entries) > 0 && !scheduler.entries[0].at.After(scheduler.Now()) {
+		entry := heap.Pop(&scheduler.entries).(*ScheduleEntry)
+		entry.run()
+	}
+	scheduler.reset()
+}
+
+// points wake at the earliest entry, if that has changed
+func (scheduler *Scheduler) reset() {
+	if len(scheduler.entries) == 0 {
+		scheduler.wake, scheduler.next = nil, time.Time{}
+		return
+	}
+	at := scheduler.entries[0].at
+	if scheduler.wake != nil && at.Equal(scheduler.next) {
+		return
+	}
+	scheduler.next = at
+	scheduler.wake = scheduler.clock.After(at.Sub(scheduler.Now()))
+}
+
+/* reads every entry in the journal. a crash can leave half a line at the
+ * end, anything that doesnt parse is skipped. no journal yet is no entries */
+func ReadJournal(path string) ([]*JournalEntry, error) {
+	entries := make([]*JournalEntry, 0)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := &JournalEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) != nil {
+			log.Println("skipped a damaged journal entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+/* writes a fresh journal holding just the given rooms and their history,
+ * swaps it in for the old one and opens it for appending */
+func CreateJournal(path string, chatRooms map[string]*ChatRoom, archives map[string]*ChatRoom) (*Journal, error) {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	journal := &Journal{path: path, file: tmp}
+	for name, chatRoom := range chatRooms {
+		journal.writeRoom(name, chatRoom)
+	}
+	for name, chatRoom := range archives {
+		journal.writeRoom(name, chatRoom)
+		journal.write(&JournalEntry{Op: JOURNAL_ARCHIVE, Room: name, Time: chatRoom.archived})
+	}
+	err = tmp.Sync()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	journal.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	journal.dirty = make(chan bool, 1)
+	journal.done = make(chan bool)
+	go journal.Flush()
+	return journal, nil
+}
 
-// creates a new client, opens reader/writer for them.
-func NewClient(conn net.Conn) *Client {
-	writer := bufio.NewWriter(conn)
-	reader := bufio.NewReader(conn)
-
-	client := &Client{
-		name:     CLIENT_NAME,
-		chatRoom: nil,
-		incoming: make(chan *Message),
-		outgoing: make(chan string),
-		conn:     conn,
-		reader:   reader,
-		writer:   writer,
+// writes everything needed to bring a room back as it is
+func (journal *Journal) writeRoom(name string, chatRoom *ChatRoom) {
+	journal.write(&JournalEntry{
+		Op:         JOURNAL_CREATE,
+		Room:       name,
+		Time:       chatRoom.LastActive(),
+		Secret:     chatRoom.secret,
+		Owner:      chatRoom.owner,
+		InviteOnly: chatRoom.inviteOnly,
+		ReadOnly:   chatRoom.readOnly,
+	})
+	for member := range chatRoom.members {
+		journal.write(&JournalEntry{Op: JOURNAL_MEMBER, Room: name, Time: chatRoom.LastActive(), Name: member})
+	}
+	if chatRoom.topic != "" || chatRoom.description != "" {
+		journal.write(&JournalEntry{Op: JOURNAL_TOPIC, Room: name, Time: chatRoom.LastActive(), Topic: chatRoom.topic, Description: chatRoom.description})
+	}
+	for banned, host := range chatRoom.bans {
+		journal.write(&JournalEntry{Op: JOURNAL_BAN, Room: name, Time: chatRoom.LastActive(), Name: banned, Host: host})
+	}
+	for moderator := range chatRoom.moderators {
+		journal.write(&JournalEntry{Op: JOURNAL_OP, Room: name, Time: chatRoom.LastActive(), Name: moderator})
 	}
+	for muted, entry := range chatRoom.muted {
+		until := entry.at
+		journal.write(&JournalEntry{Op: JOURNAL_MUTE, Room: name, Time: chatRoom.LastActive(), Name: muted, Until: &until})
+	}
+	for _, frame := range chatRoom.messages {
+		journal.write(&JournalEntry{Op: JOURNAL_MESSAGE, Room: name, Time: frame.Time, Frame: frame})
+	}
+}
 
-	client.Listen()
-	return client
+/* writes an entry and asks for a sync without waiting for it, a fsync per
+ * message would hold up the whole lobby. a nil journal keeps nothing */
+func (journal *Journal) Append(entry *JournalEntry) {
+	if journal == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if err := journal.write(entry); err != nil {
+		log.Println("Error: could not write to journal", err)
+		return
+	}
+	select {
+	case journal.dirty <- true:
+	default:
+		// a sync is already due and will include this entry
+	}
 }
 
-// creates two threads to read and write
-func (client *Client) Listen() {
-	go client.Read()
-	go client.Write()
+/* syncs the journal whenever there are new entries. everything appended
+ * while a sync runs goes to disk together in the next one */
+func (journal *Journal) Flush() {
+	for _ = range journal.dirty {
+		if err := journal.file.Sync(); err != nil {
+			log.Println("Error: could not sync journal", err)
+		}
+	}
+	close(journal.done)
 }
 
-/* reads string from client, formats into message or returns error. 
- * sends it back to client */
-func (client *Client) Read() {
+// waits for the last sync and closes the file, nothing can be appended after
+func (journal *Journal) Close() error {
+	if journal == nil {
+		return nil
+	}
+	close(journal.dirty)
+	<-journal.done
+	return journal.file.Close()
+}
+
+// writes one entry as a line of JSON
+func (journal *Journal) write(entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = journal.file.Write(append(data, '\n'))
+	return err
+}
+
+// accepts irc clients, they join the same lobby as everyone else
+func (lobby *Lobby) ListenIRC(config *Config) {
+	listener, err := config.TLS.Listen(IRC_PORT)
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	defer listener.Close()
+	log.Println("Listening for irc on " + IRC_PORT)
+	lobby.Accept(listener, PROTO_IRC, TELNET_OFF)
+}
+
+// accepts telnet clients, the server negotiates echo and window size with them
+func (lobby *Lobby) ListenTelnet(config *Config) {
+	listener, err := config.TLS.Listen(TELNET_PORT)
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	defer listener.Close()
+	log.Println("Listening for telnet on " + TELNET_PORT)
+	lobby.Accept(listener, PROTO_PLAIN, TELNET_ACTIVE)
+}
+
+/* accepts connections, clients join the lobby speaking the given protocol.
+ * the tls handshake is finished off the accept thread, with mutual tls the
+ * name on the client certificate becomes the clients name */
+func (lobby *Lobby) Accept(listener net.Listener, protocol int, telnet int) {
 	for {
-		str, err := client.reader.ReadString('\n')
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Println(err)
-			break
+			log.Println("Error: ", err)
+			continue
 		}
-		message := NewMessage(time.Now(), client, strings.TrimSuffix(str, "\n"))
-		client.incoming <- message
+		go func(conn net.Conn) {
+			certName := PeerName(conn)
+			if telnet != TELNET_OFF {
+				conn = NewTelnetConn(conn, telnet == TELNET_ACTIVE)
+			}
+			client := NewClient(conn, protocol)
+			if certName != "" {
+				client.certName = certName
+				client.SetName(certName)
+			}
+			lobby.join <- client
+		}(conn)
 	}
-	close(client.incoming)
-	log.Println("Closed client's incoming channel read thread")
 }
 
-// reads message from outgoing, writes to socket
-func (client *Client) Write() {
-	for str := range client.outgoing {
-		_, err := client.writer.WriteString(str)
-		if err != nil {
-			log.Println(err)
-			break
+// reads config.json from the working directory
+func LoadConfig() *Config {
+	config := &Config{
+		Journal: JOURNAL_FILE,
+		Users:   USERS_FILE,
+		ExpiryWarning: EXPIRY_WARNING,
+		ResumeGrace:   RESUME_GRACE,
+		Announcements: AnnouncementsConfig{
+			Room:    ANNOUNCEMENTS,
+			Welcome: MSG_CONNECT,
+		},
+		History: HistoryConfig{
+			MaxMessages: HISTORY_MAX_MESSAGES,
+			MaxBytes:    HISTORY_MAX_BYTES,
+			Replay:      HISTORY_REPLAY,
+		},
+	}
+	data, err := ioutil.ReadFile(CONFIG_FILE)
+	if err != nil {
+		log.Println("no " + CONFIG_FILE + ", using defaults")
+		config.expiryWarning, _ = time.ParseDuration(EXPIRY_WARNING)
+		config.resumeGrace, _ = time.ParseDuration(RESUME_GRACE)
+		return config
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	if config.ExpiryWarning == "" {
+		config.ExpiryWarning = EXPIRY_WARNING
+	}
+	config.expiryWarning, err = time.ParseDuration(config.ExpiryWarning)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	if config.ResumeGrace == "" {
+		config.ResumeGrace = RESUME_GRACE
+	}
+	config.resumeGrace, err = time.ParseDuration(config.ResumeGrace)
+	if err != nil {
+		log.Println("Error: ", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+// listens on the address, wrapped in tls if it is enabled
+func (config *TLSConfig) Listen(address string) (net.Listener, error) {
+	listener, err := net.Listen(CONN_TYPE, address)
+	if err != nil || !config.Enabled {
+		return listener, err
+	}
+	tlsConfig, err := config.Server()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// builds the servers tls config, generating a dev certificate if asked to
+func (config *TLSConfig) Server() (*tls.Config, error) {
+	if config.GenerateCert {
+		if _, err := os.Stat(config.CertFile); os.IsNotExist(err) {
+			err = GenerateCert(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			log.Println("generated self-signed certificate " + config.CertFile)
 		}
-		err = client.writer.Flush()
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.ClientAuth {
+		data, err := ioutil.ReadFile(config.CAFile)
 		if err != nil {
-			log.Println(err)
-			break
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates in " + config.CAFile)
 		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = pool
 	}
-	log.Println("Closed client's write thread")
+	return tlsConfig, nil
 }
 
-// close clients connection
-func (client *Client) Quit() {
-	client.conn.Close()
+// returns the CN of the client certificate, or "" without tls or a certificate
+func PeerName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIME))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+/* writes a self-signed certificate for localhost. clients can trust it by
+ * using it as their CAFile, good enough for development only.
+ * PeerName and GenerateCert have a twin in Evan's Work/util/tls.go, the two
+ * trees build separately so a fix to one belongs in the other */
+func GenerateCert(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(DEV_CERT_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// splits an irc line into its command and parameters
+func NewIRCCommand(line string) *IRCCommand {
+	if strings.HasPrefix(line, ":") {
+		// prefixes from clients are ignored
+		end := strings.Index(line, " ")
+		if end < 0 {
+			return &IRCCommand{}
+		}
+		line = line[end+1:]
+	}
+	trailing := ""
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing = line[i+2:]
+		hasTrailing = true
+		line = line[:i]
+	}
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return &IRCCommand{}
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return &IRCCommand{
+		command: strings.ToUpper(params[0]),
+		params:  params[1:],
+	}
+}
+
+/* maps irc commands onto the lobby. replies the lobby already sends show up
+ * as NOTICEs, the numerics irc clients need to open windows are added here */
+func (lobby *Lobby) ParseIRC(message *Message) {
+	client := message.client
+	cmd := NewIRCCommand(message.text)
+
+	switch cmd.command {
+	case "":
+		return
+	case "CAP":
+		if len(cmd.params) > 0 && strings.ToUpper(cmd.params[0]) == "LS" {
+			client.Raw(fmt.Sprintf(":%s CAP * LS :", IRC_SERVER))
+		}
+		return
+	case "PING":
+		client.Raw(fmt.Sprintf(":%s PONG %s :%s", IRC_SERVER, IRC_SERVER, strings.Join(cmd.params, " ")))
+		return
+	case "PONG":
+		return
+	case "QUIT":
+		client.quitting = true
+		client.Quit()
+		return
+	case "NICK":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NONICKNAMEGIVEN, ":No nickname given")
+			return
+		}
+		switch refusal := lobby.CheckName(client, cmd.params[0]); {
+		case refusal == ERROR_NAME:
+			client.IRCReply(IRC_ERRONEUSNICKNAME, cmd.params[0]+" :Erroneous nickname")
+			return
+		case refusal == ERROR_CERT_NAME:
+			client.Error(refusal)
+		case refusal != "":
+			client.IRCReply(IRC_NICKNAMEINUSE, cmd.params[0]+" :Nickname is already in use")
+			return
+		default:
+			if client.ircReady {
+				client.Raw(fmt.Sprintf(":%s!%s@%s NICK :%s", client.name, client.name, IRC_SERVER, cmd.params[0]))
+			}
+			lobby.ChangeName(client, cmd.params[0])
+			client.ircNick = true
+		}
+		lobby.WelcomeIRC(client)
+		return
+	case "USER":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "USER :Not enough parameters")
+			return
+		}
+		client.ircUser = cmd.params[0]
+		lobby.WelcomeIRC(client)
+		return
+	}
+
+	if !client.ircReady {
+		client.IRCReply(IRC_NOTREGISTERED, ":You have not registered")
+		return
+	}
+
+	switch cmd.command {
+	default:
+		client.IRCReply(IRC_UNKNOWNCOMMAND, cmd.command+" :Unknown command")
+	case "JOIN":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "JOIN :Not enough parameters")
+			return
+		}
+		keys := make([]string, 0)
+		if len(cmd.params) > 1 {
+			keys = strings.Split(cmd.params[1], ",")
+		}
+		for i, channel := range strings.Split(cmd.params[0], ",") {
+			key := ""
+			if i < len(keys) {
+				key = keys[i]
+			}
+			lobby.JoinIRC(client, strings.TrimPrefix(channel, "#"), key)
+		}
+	case "PART":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "PART :Not enough parameters")
+			return
+		}
+		for _, channel := range strings.Split(cmd.params[0], ",") {
+			chatRoom := client.Room(strings.TrimPrefix(channel, "#"))
+			if chatRoom == nil {
+				client.IRCReply(IRC_NOTONCHANNEL, channel+" :You're not on that channel")
+				continue
+			}
+			client.Raw(fmt.Sprintf(":%s!%s@%s PART #%s", client.name, client.name, IRC_SERVER, chatRoom.name))
+			chatRoom.Leave(client)
+		}
+	case "PRIVMSG":
+		if len(cmd.params) < 2 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "PRIVMSG :Not enough parameters")
+			return
+		}
+		target := cmd.params[0]
+		if !strings.HasPrefix(target, "#") {
+			other := lobby.FindClient(target)
+			if other == nil {
+				client.IRCReply(IRC_NOSUCHNICK, target+" :No such nick/channel")
+				return
+			}
+			lobby.SendPrivate(NewMessage(message.time, client, cmd.params[1]), other)
+			return
+		}
+		chatRoom := client.Room(strings.TrimPrefix(target, "#"))
+		if chatRoom == nil {
+			client.IRCReply(IRC_CANNOTSENDTOCHAN, target+" :Cannot send to channel")
+			return
+		}
+		reply := NewMessage(message.time, client, cmd.params[1])
+		reply.raw = true
+		lobby.SendMessageTo(reply, chatRoom)
+	case "INVITE":
+		if len(cmd.params) < 2 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "INVITE :Not enough parameters")
+			return
+		}
+		channel := cmd.params[1]
+		chatRoom := client.Room(strings.TrimPrefix(channel, "#"))
+		if chatRoom == nil {
+			client.IRCReply(IRC_NOTONCHANNEL, channel+" :You're not on that channel")
+			return
+		}
+		if !chatRoom.OwnedBy(client) {
+			client.IRCReply(IRC_CHANOPRIVSNEEDED, channel+" :You're not channel operator")
+			return
+		}
+		if lobby.FindClient(cmd.params[0]) == nil {
+			client.IRCReply(IRC_NOSUCHNICK, cmd.params[0]+" :No such nick/channel")
+			return
+		}
+		// irc has no active room, commands act on the channel they name
+		client.chatRoom = chatRoom
+		lobby.Invite(client, cmd.params[0])
+		client.IRCReply(IRC_INVITING, cmd.params[0]+" "+channel)
+	case "AWAY":
+		if len(cmd.params) < 1 || cmd.params[0] == "" {
+			client.away = ""
+			client.IRCReply(IRC_UNAWAY, ":You are no longer marked as being away")
+			return
+		}
+		client.away = cmd.params[0]
+		client.IRCReply(IRC_NOWAWAY, ":You have been marked as being away")
+	case "NOTICE":
+		// clients must never get automatic replies to NOTICE, so dont send errors either
+	case "LIST":
+		client.IRCReply(IRC_LISTSTART, "Channel :Users  Name")
+		chatRooms := make([]*ChatRoom, 0, len(lobby.chatRooms))
+		for _, chatRoom := range lobby.chatRooms {
+			if chatRoom.Visible(client) {
+				chatRooms = append(chatRooms, chatRoom)
+			}
+		}
+		SortChatRooms(chatRooms, LIST_SORT_NAME)
+		for _, chatRoom := range chatRooms {
+			client.IRCReply(IRC_LIST, fmt.Sprintf("#%s %d :%s", chatRoom.name, len(chatRoom.clients), chatRoom.topic))
+		}
+		client.IRCReply(IRC_LISTEND, ":End of LIST")
+	case "NAMES":
+		if len(cmd.params) < 1 {
+			if client.chatRoom != nil {
+				lobby.NamesIRC(client, client.chatRoom.name)
+			}
+			return
+		}
+		for _, channel := range strings.Split(cmd.params[0], ",") {
+			lobby.NamesIRC(client, strings.TrimPrefix(channel, "#"))
+		}
+	case "TOPIC":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NEEDMOREPARAMS, "TOPIC :Not enough parameters")
+			return
+		}
+		channel := cmd.params[0]
+		chatRoom := lobby.chatRooms[strings.TrimPrefix(channel, "#")]
+		if chatRoom == nil || !chatRoom.Visible(client) {
+			client.IRCReply(IRC_NOSUCHCHANNEL, channel+" :No such channel")
+			return
+		}
+		if len(cmd.params) > 1 {
+			if client.Room(chatRoom.name) == nil {
+				client.IRCReply(IRC_NOTONCHANNEL, channel+" :You're not on that channel")
+				return
+			}
+			if !chatRoom.Moderator(client) {
+				client.IRCReply(IRC_CHANOPRIVSNEEDED, channel+" :You're not channel operator")
+				return
+			}
+			client.chatRoom = chatRoom
+			lobby.Topic(client, cmd.params[1])
+			return
+		}
+		lobby.TopicIRC(client, chatRoom)
+	case "MODE":
+		if len(cmd.params) > 0 && strings.HasPrefix(cmd.params[0], "#") {
+			client.IRCReply(IRC_CHANNELMODEIS, cmd.params[0]+" +")
+		}
+	case "WHO":
+		target := "*"
+		if len(cmd.params) > 0 {
+			target = cmd.params[0]
+		}
+		lobby.WhoIRC(client, target)
+		client.IRCReply(IRC_ENDOFWHO, target+" :End of WHO list")
+	case "WHOIS":
+		if len(cmd.params) < 1 {
+			client.IRCReply(IRC_NONICKNAMEGIVEN, ":No nickname given")
+			return
+		}
+		// "WHOIS server nick" asks a particular server, there is only this one
+		lobby.WhoisIRC(client, cmd.params[len(cmd.params)-1])
+	}
+	log.Println("irc client sent", cmd.command)
 }
 
+// sends the welcome numerics once both NICK and USER have arrived
+func (lobby *Lobby) WelcomeIRC(client *Client) {
+	if client.ircReady || client.ircUser == "" || (!client.ircNick && client.certName == "") {
+		return
+	}
+	client.ircReady = true
+	client.IRCReply(IRC_WELCOME, ":Welcome to the chat server "+client.name)
+	client.IRCReply(IRC_YOURHOST, ":Your host is "+IRC_SERVER)
+	client.IRCReply(IRC_CREATED, ":This server was created for cmpt436")
+	client.IRCReply(IRC_MYINFO, IRC_SERVER+" ken o o")
+	client.IRCReply(IRC_NOMOTD, ":MOTD File is missing")
+	lobby.JoinAnnouncements(client)
+	log.Println("irc client registered")
+}
+
+/* joins a room for an irc client. the client stays in its other channels,
+ * so no PART is sent for them */
+func (lobby *Lobby) JoinIRC(client *Client, name string, key string) {
+	if lobby.chatRooms[name] == nil {
+		if suggestions := lobby.Suggest(client, name); len(suggestions) > 0 {
+			client.IRCReply(IRC_NOSUCHCHANNEL, "#"+name+" :No such channel, did you mean #"+suggestions[0]+"?")
+			return
+		}
+		client.IRCReply(IRC_NOSUCHCHANNEL, "#"+name+" :No such channel")
+		return
+	}
+	switch lobby.chatRooms[name].Admit(client) {
+	case ERROR_INVITE_ONLY:
+		client.IRCReply(IRC_INVITEONLYCHAN, "#"+name+" :Cannot join channel (+i)")
+		return
+	case ERROR_PASSWORD:
+		if key != "" {
+			lobby.CheckRoomPassword(client, name, key)
+			return
+		}
+		client.IRCReply(IRC_BADCHANNELKEY, "#"+name+" :Cannot join channel (+k)")
+		return
+	case ERROR_BANNED:
+		client.IRCReply(IRC_BANNEDFROMCHAN, "#"+name+" :Cannot join channel (+b)")
+		return
+	}
+	if client.Room(name) != nil {
+		return
+	}
+	client.Raw(fmt.Sprintf(":%s!%s@%s JOIN #%s", client.name, client.name, IRC_SERVER, name))
+	lobby.JoinChatRoom(client, name, key)
+	lobby.TopicIRC(client, lobby.chatRooms[name])
+	lobby.NamesIRC(client, name)
+}
+
+// sends RPL_TOPIC, or RPL_NOTOPIC if there isnt one
+func (lobby *Lobby) TopicIRC(client *Client, chatRoom *ChatRoom) {
+	if chatRoom.topic == "" {
+		client.IRCReply(IRC_NOTOPIC, "#"+chatRoom.name+" :No topic is set")
+		return
+	}
+	client.IRCReply(IRC_TOPIC, "#"+chatRoom.name+" :"+chatRoom.topic)
+}
+
+/* RPL_WHOREPLY for everyone in a channel, one nick, or everyone online for
+ * "*". addresses are left out, like in prefixes */
+func (lobby *Lobby) WhoIRC(client *Client, target string) {
+	clients, channel := lobby.clients, "*"
+	var chatRoom *ChatRoom
+	if strings.HasPrefix(target, "#") {
+		chatRoom = lobby.chatRooms[strings.TrimPrefix(target, "#")]
+		if chatRoom == nil || !chatRoom.Visible(client) {
+			return
+		}
+		clients, channel = chatRoom.clients, target
+	} else if target != "*" && target != "0" {
+		other := lobby.FindClient(target)
+		if other == nil {
+			return
+		}
+		clients = []*Client{other}
+	}
+	for _, other := range clients {
+		flags := "H"
+		if other.away != "" {
+			flags = "G"
+		}
+		if chatRoom != nil && chatRoom.Moderator(other) {
+			flags += "@"
+		}
+		client.IRCReply(IRC_WHOREPLY, fmt.Sprintf("%s %s %s %s %s %s :0 %s", channel, other.IRCUser(), IRC_SERVER, IRC_SERVER, other.Name(), flags, other.Name()))
+	}
+}
+
+// the WHOIS replies, the real address only goes to moderators like /whois
+func (lobby *Lobby) WhoisIRC(client *Client, nick string) {
+	target := lobby.FindClient(nick)
+	if target == nil {
+		client.IRCReply(IRC_NOSUCHNICK, nick+" :No such nick/channel")
+		client.IRCReply(IRC_ENDOFWHOIS, nick+" :End of WHOIS list")
+		return
+	}
+	nick = target.Name()
+	now := lobby.scheduler.Now()
+	client.IRCReply(IRC_WHOISUSER, fmt.Sprintf("%s %s %s * :%s", nick, target.IRCUser(), IRC_SERVER, nick))
+	channels := make([]string, 0, len(target.chatRooms))
+	for _, chatRoom := range target.chatRooms {
+		if !chatRoom.Visible(client) {
+			continue
+		}
+		if chatRoom.Moderator(target) {
+			channels = append(channels, "@#"+chatRoom.name)
+		} else {
+			channels = append(channels, "#"+chatRoom.name)
+		}
+	}
+	if len(channels) > 0 {
+		client.IRCReply(IRC_WHOISCHANNELS, nick+" :"+strings.Join(channels, " "))
+	}
+	client.IRCReply(IRC_WHOISSERVER, nick+" "+IRC_SERVER+" :"+IRC_SERVER)
+	if target.away != "" {
+		client.IRCReply(IRC_AWAY, nick+" :"+target.away)
+	}
+	if lobby.Moderates(client, target) {
+		client.IRCReply(IRC_WHOISHOST, nick+" :is connecting from *@"+target.Host())
+	}
+	client.IRCReply(IRC_WHOISIDLE, fmt.Sprintf("%s %d %d :seconds idle, signon time", nick, int(target.Idle(now).Seconds()), target.connected.Unix()))
+	client.IRCReply(IRC_ENDOFWHOIS, nick+" :End of WHOIS list")
+}
+
+// lists the members of a room as RPL_NAMREPLY
+func (lobby *Lobby) NamesIRC(client *Client, name string) {
+	chatRoom := lobby.chatRooms[name]
+	if chatRoom != nil {
+		names := make([]string, 0, len(chatRoom.clients))
+		for _, member := range chatRoom.clients {
+			names = append(names, member.name)
+		}
+		client.IRCReply(IRC_NAMREPLY, "= #"+name+" :"+strings.Join(names, " "))
+	}
+	client.IRCReply(IRC_ENDOFNAMES, "#"+name+" :End of NAMES list")
+}
+
+// sends a numeric reply addressed to the client
+func (client *Client) IRCReply(numeric string, params string) {
+	client.Raw(fmt.Sprintf(":%s %s %s %s", IRC_SERVER, numeric, client.name, params))
+}
 
 // Creates a new message with the given time, client and text.
 func NewMessage(time time.Time, client *Client, text string) *Message {
@@ -409,18 +4261,51 @@ func NewMessage(time time.Time, client *Client, text string) *Message {
 	}
 }
 
-// returns a string with time, sender, and message (from NewMessage)
-func (message *Message) String() string {
-	return fmt.Sprintf("%s - %s: %s\n", message.time.Format(time.Kitchen), message.client.name, message.text)
+// returns a chat frame with time, sender, and message (from NewMessage)
+func (message *Message) Frame() *Frame {
+	frame := NewFrame(FRAME_MSG, message.client.name, message.text)
+	frame.Time = message.time
+	frame.from = message.client
+	return frame
+}
+
+// Creates a new frame stamped with the next id. Payloads are stored without
+// the trailing newline the plain text constants carry.
+func NewFrame(frameType string, sender string, payload string) *Frame {
+	return &Frame{
+		Version: PROTO_VERSION,
+		Type:    frameType,
+		Sender:  sender,
+		Time:    time.Now(),
+		Id:      atomic.AddUint64(&lastFrameId, 1),
+		Payload: strings.TrimSuffix(payload, "\n"),
+	}
+}
+
+// returns the plain text form, chat lines get the time and sender prepended
+func (frame *Frame) String() string {
+	room := ""
+	if frame.Room != "" {
+		// clients can be in several rooms, say which one it came from
+		room = "[" + frame.Room + "] "
+	}
+	if frame.To != "" {
+		room = "[private to " + frame.To + "] "
+	}
+	if frame.Type == FRAME_MSG {
+		return fmt.Sprintf("%s%s - %s: %s\n", room, frame.Time.Format(time.Kitchen), frame.Sender, frame.Payload)
+	}
+	return room + frame.Payload + "\n"
 }
 
 // creates the lobby, listens for connections
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	lobby := NewLobby()
+	config := LoadConfig()
+	lobby := NewLobby(config, SystemClock{})
 
-	listener, err := net.Listen(CONN_TYPE, CONN_PORT)
+	listener, err := config.TLS.Listen(CONN_PORT)
 	if err != nil {
 		log.Println("Error: ", err)
 		os.Exit(1)
@@ -428,12 +4313,23 @@ func main() {
 	defer listener.Close()
 	log.Println("Listening on " + CONN_PORT)
 
-	for {
-		conn, err := listener.Accept()
+	go lobby.ListenIRC(config)
+	go lobby.ListenTelnet(config)
+
+	// browsers connect to ws://host:1235/chat (wss:// with tls)
+	http.Handle(WS_PATH, websocket.Handler(lobby.ServeWS))
+	go func() {
+		wsListener, err := config.TLS.Listen(WS_PORT)
 		if err != nil {
 			log.Println("Error: ", err)
-			continue
+			return
 		}
-		lobby.Join(NewClient(conn))
-	}
+		log.Println("Listening for websockets on " + WS_PORT + WS_PATH)
+		err = http.Serve(wsListener, nil)
+		if err != nil {
+			log.Println("Error: ", err)
+		}
+	}()
+
+	lobby.Accept(listener, PROTO_PLAIN, TELNET_PASSIVE)
 }
\ No newline at end of file
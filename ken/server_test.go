@@ -0,0 +1,1090 @@
+package main
+
+// client.go is a separate program in the same directory, so test the
+// server on its own: go test server.go server_test.go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a clock that only moves when the test says so
+type testClock struct {
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time                         { return clock.now }
+func (clock *testClock) After(d time.Duration) <-chan time.Time { return nil }
+
+// a lobby keeping its journal and users in dir, driven from the test thread
+func testLobby(dir string, clock Clock) *Lobby {
+	config := &Config{
+		Journal: filepath.Join(dir, JOURNAL_FILE),
+		Users:   filepath.Join(dir, USERS_FILE),
+		History: HistoryConfig{
+			MaxMessages: HISTORY_MAX_MESSAGES,
+			MaxBytes:    HISTORY_MAX_BYTES,
+			Replay:      HISTORY_REPLAY,
+		},
+	}
+	return OpenLobby(config, clock)
+}
+
+// a connected client whose output piles up instead of going anywhere
+func testClient(lobby *Lobby, name string, account string) *Client {
+	conn, _ := net.Pipe()
+	client := &Client{
+		name:     name,
+		account:  account,
+		conn:     conn,
+		incoming: make(chan *Message),
+		outgoing: make(chan *Frame, 1000),
+		lastRead: lobby.scheduler.Now(),
+	}
+	client.connected = client.lastRead
+	lobby.clients = append(lobby.clients, client)
+	return client
+}
+
+// registers names without the slow hashing, the tests never log in with them
+func testAccounts(t *testing.T, lobby *Lobby, names ...string) {
+	for _, name := range names {
+		lobby.users.accounts[name] = &Account{Created: lobby.scheduler.Now()}
+	}
+	if err := lobby.users.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInviteOnlyRoomSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(dir, clock)
+	testAccounts(t, lobby, "alice", "bob")
+	alice := testClient(lobby, "alice", "alice")
+	testClient(lobby, "bob", "bob")
+	lobby.CreateChatRoom(alice, "secret", "")
+	lobby.JoinChatRoom(alice, "secret", "")
+	lobby.Invite(alice, "bob")
+
+	lobby = testLobby(dir, clock)
+	chatRoom := lobby.chatRooms["secret"]
+	if chatRoom == nil {
+		t.Fatal("room was not restored")
+	}
+	if !chatRoom.inviteOnly || chatRoom.owner != "alice" {
+		t.Fatalf("restored inviteOnly=%v owner=%q, want true and alice", chatRoom.inviteOnly, chatRoom.owner)
+	}
+	alice = testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	carol := testClient(lobby, "carol", "")
+	if refusal := chatRoom.Admit(bob); refusal != "" {
+		t.Fatalf("invited member refused after restart: %q", refusal)
+	}
+	if refusal := chatRoom.Admit(carol); refusal != ERROR_INVITE_ONLY {
+		t.Fatalf("uninvited guest got %q, want ERROR_INVITE_ONLY", refusal)
+	}
+	lobby.JoinChatRoom(alice, "secret", "")
+	lobby.Invite(alice, "carol")
+	if refusal := chatRoom.Admit(carol); refusal != "" {
+		t.Fatalf("owner could not invite after restart, carol got %q", refusal)
+	}
+}
+
+func TestGuestGivesUpRoomOnLeave(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	guest := testClient(lobby, "new_user1", "")
+	lobby.CreateChatRoom(guest, "games", "")
+	if !lobby.chatRooms["games"].OwnedBy(guest) {
+		t.Fatal("creator does not own the room")
+	}
+	lobby.Leave(guest)
+	next := testClient(lobby, "new_user1", "")
+	if lobby.chatRooms["games"].OwnedBy(next) {
+		t.Fatal("the next guest with the name took over the room")
+	}
+}
+
+func TestModeratorsAndMutesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(dir, clock)
+	testAccounts(t, lobby, "alice", "bob", "carol")
+	alice := testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	carol := testClient(lobby, "carol", "carol")
+	lobby.CreateChatRoom(alice, "games", "")
+	for _, client := range []*Client{alice, bob, carol} {
+		lobby.JoinChatRoom(client, "games", "")
+	}
+	lobby.Op(alice, "bob")
+	lobby.MuteMember(alice, "carol 10m")
+	lobby.Leave(bob)
+	lobby.Leave(carol)
+
+	clock.now = clock.now.Add(time.Minute)
+	lobby = testLobby(dir, clock)
+	chatRoom := lobby.chatRooms["games"]
+	bob = testClient(lobby, "bob", "bob")
+	if !chatRoom.Moderator(bob) {
+		t.Fatal("moderator lost their rights over a restart")
+	}
+	entry := chatRoom.muted["carol"]
+	if entry == nil {
+		t.Fatal("mute was lifted by a restart")
+	}
+	if left := entry.at.Sub(clock.now); left != 9*time.Minute {
+		t.Fatalf("mute has %v left, want 9m", left)
+	}
+}
+
+func TestBanLeavesHostUnlessAsked(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice")
+	alice := testClient(lobby, "alice", "alice")
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	bob := testClient(lobby, "bob", "")
+	carol := testClient(lobby, "carol", "")
+	dave := testClient(lobby, "dave", "")
+	lobby.JoinChatRoom(bob, "games", "")
+	chatRoom := lobby.chatRooms["games"]
+
+	lobby.Ban(alice, "bob", false)
+	if !chatRoom.Banned(bob) {
+		t.Fatal("banned name can still get in")
+	}
+	if chatRoom.Banned(carol) {
+		t.Fatal("a name ban locked out someone else on the same address")
+	}
+	lobby.Ban(alice, "carol", true)
+	if !chatRoom.Banned(dave) {
+		t.Fatal("a host ban did not lock out the address")
+	}
+}
+
+func TestCertNamesAreUnique(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice")
+	guest := testClient(lobby, "carol", "")
+	cert := &Client{name: "carol", certName: "carol", outgoing: make(chan *Frame, 1000)}
+	if refusal := lobby.ClaimCertName(cert); refusal != "" {
+		t.Fatal("certificate lost its name to a guest:", refusal)
+	}
+	if guest.Name() == "carol" {
+		t.Fatal("guest kept the certificate's name")
+	}
+	lobby.clients = append(lobby.clients, cert)
+
+	again := &Client{name: "carol", certName: "carol", outgoing: make(chan *Frame, 1000)}
+	if lobby.ClaimCertName(again) == "" {
+		t.Fatal("second connection with the same certificate was let in")
+	}
+	registered := &Client{name: "alice", certName: "alice", outgoing: make(chan *Frame, 1000)}
+	if lobby.ClaimCertName(registered) == "" {
+		t.Fatal("certificate took a registered name")
+	}
+	if lobby.CheckName(guest, "carol") == "" {
+		t.Fatal("guest can take the name back")
+	}
+
+	testAccounts(t, lobby, "carol")
+	dave := testClient(lobby, "dave", "")
+	lobby.FinishLogin(&Login{client: dave, name: "carol", ok: true})
+	if dave.Name() != "dave" || cert.Name() != "carol" {
+		t.Fatal("login moved the certificate off its name")
+	}
+}
+
+func TestBanProtectsOfflineModerators(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice", "bob", "carol")
+	alice := testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	carol := testClient(lobby, "carol", "carol")
+	lobby.CreateChatRoom(alice, "games", "")
+	chatRoom := lobby.chatRooms["games"]
+	for _, client := range []*Client{alice, bob, carol} {
+		lobby.JoinChatRoom(client, "games", "")
+	}
+	lobby.AddModerator(chatRoom, bob)
+	lobby.AddModerator(chatRoom, carol)
+	lobby.Leave(alice)
+	lobby.Leave(bob)
+
+	lobby.Ban(carol, "bob", false)
+	lobby.Ban(carol, "alice", false)
+	if _, ok := chatRoom.bans["bob"]; ok || !chatRoom.moderators["bob"] {
+		t.Fatal("a moderator banned another one while they were offline")
+	}
+	if _, ok := chatRoom.bans["alice"]; ok {
+		t.Fatal("a moderator banned the creator while they were offline")
+	}
+
+	alice = testClient(lobby, "alice", "alice")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.Ban(alice, "bob", false)
+	if _, ok := chatRoom.bans["bob"]; !ok || chatRoom.moderators["bob"] {
+		t.Fatal("the creator could not ban an offline moderator")
+	}
+}
+
+func TestRefuseWhileClientStillSending(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	server, remote := net.Pipe()
+	client := NewClient(server, PROTO_JSON)
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(remote)
+		output <- string(data)
+	}()
+	// replies from the read thread, which used to race the closed outgoing
+	remote.Write([]byte("not a frame\n"))
+	lobby.Refuse(client, "go away\n")
+	go func() {
+		remote.Write([]byte("not a frame either\n"))
+		remote.Write([]byte("{\"type\":\"cmd\",\"payload\":\"/proto plain\"}\n"))
+	}()
+	select {
+	case text := <-output:
+		if !strings.Contains(text, "go away") {
+			t.Fatalf("refused client was sent %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refused connection was never closed")
+	}
+}
+
+func TestWrongPasswordsBackOff(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	client := testClient(lobby, "new_user1", "")
+	if !lobby.StartHashing(client) {
+		t.Fatal("first login was refused")
+	}
+	if lobby.StartHashing(client) {
+		t.Fatal("a second login started before the first came back")
+	}
+	lobby.FinishLogin(&Login{client: client, name: "alice"})
+	if lobby.StartHashing(client) {
+		t.Fatal("login straight after a wrong password was let through")
+	}
+	clock.now = clock.now.Add(LOGIN_BACKOFF)
+	if !lobby.StartHashing(client) {
+		t.Fatal("login still refused once the backoff was over")
+	}
+	lobby.FinishLogin(&Login{client: client, name: "alice"})
+	clock.now = clock.now.Add(LOGIN_BACKOFF)
+	if lobby.StartHashing(client) {
+		t.Fatal("backoff did not grow after a second wrong password")
+	}
+	clock.now = clock.now.Add(LOGIN_BACKOFF)
+	if !lobby.StartHashing(client) {
+		t.Fatal("login still refused after twice the backoff")
+	}
+}
+
+func TestAnnouncersByAccount(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice", "bob")
+	lobby.OpenAnnouncements(&AnnouncementsConfig{Room: ANNOUNCEMENTS, Accounts: []string{"alice"}})
+	chatRoom := lobby.announcements
+	alice := testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	guest := testClient(lobby, "carol", "")
+	for _, client := range []*Client{alice, bob, guest} {
+		lobby.JoinAnnouncements(client)
+	}
+	if !chatRoom.Moderator(alice) {
+		t.Fatal("configured account cannot post announcements")
+	}
+	if chatRoom.Moderator(bob) || chatRoom.Moderator(guest) {
+		t.Fatal("someone outside the config can post announcements")
+	}
+	lobby.Op(alice, "bob")
+	if !chatRoom.Moderator(bob) {
+		t.Fatal("announcer could not /op someone")
+	}
+	chatRoom.announcers = &AnnouncementsConfig{}
+	if chatRoom.Moderator(alice) {
+		t.Fatal("announcer kept their rights after leaving the config")
+	}
+}
+
+func TestAnnouncersCannotSeeAddresses(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice")
+	lobby.OpenAnnouncements(&AnnouncementsConfig{Room: ANNOUNCEMENTS, Accounts: []string{"alice"}})
+	alice := testClient(lobby, "alice", "alice")
+	guest := testClient(lobby, "bob", "")
+	lobby.JoinAnnouncements(alice)
+	lobby.JoinAnnouncements(guest)
+	if lobby.Moderates(alice, guest) {
+		t.Fatal("announcer can see the address of everyone who connects")
+	}
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(guest, "games", "")
+	if !lobby.Moderates(alice, guest) {
+		t.Fatal("owner cannot see the address of someone in their room")
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	scheduler := NewScheduler(clock)
+	ran := ""
+	add := func(d time.Duration, name string) *ScheduleEntry {
+		return scheduler.After(d, func() { ran += name })
+	}
+	add(2*time.Minute, "c")
+	add(time.Minute, "a")
+	add(time.Minute, "b")
+	cancelled := add(time.Minute, "x")
+	moved := add(time.Minute, "d")
+	scheduler.Cancel(cancelled)
+	scheduler.Reschedule(moved, clock.now.Add(3*time.Minute))
+
+	scheduler.Run()
+	if ran != "" {
+		t.Fatalf("ran %q before anything was due", ran)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	scheduler.Run()
+	if ran != "ab" {
+		t.Fatalf("ran %q, want entries due together in the order they were added", ran)
+	}
+	clock.now = clock.now.Add(5 * time.Minute)
+	scheduler.Run()
+	if ran != "abcd" {
+		t.Fatalf("ran %q, want the rest by time and nothing cancelled", ran)
+	}
+
+	// an entry that already ran goes back in when rescheduled
+	scheduler.Reschedule(moved, clock.now.Add(time.Minute))
+	scheduler.Cancel(cancelled)
+	clock.now = clock.now.Add(time.Minute)
+	scheduler.Run()
+	if ran != "abcdd" {
+		t.Fatalf("ran %q, want the rescheduled entry to run again", ran)
+	}
+}
+
+func TestRoomExpiry(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	lobby.warning = time.Hour
+	guest := testClient(lobby, "new_user1", "")
+	lobby.CreateChatRoom(guest, "games", "")
+	lobby.JoinChatRoom(guest, "games", "")
+	chatRoom := lobby.chatRooms["games"]
+	for len(guest.outgoing) > 0 {
+		<-guest.outgoing
+	}
+
+	clock.now = clock.now.Add(EXPIRY_TIME - time.Hour)
+	lobby.scheduler.Run()
+	if len(guest.outgoing) != 1 {
+		t.Fatalf("got %d frames, want the expiry warning", len(guest.outgoing))
+	}
+	<-guest.outgoing
+
+	// talking puts it off, it is checked again when it was due and left open
+	clock.now = clock.now.Add(time.Minute)
+	lobby.SendMessage(NewMessage(clock.now, guest, "still here"))
+	clock.now = clock.now.Add(time.Hour)
+	lobby.scheduler.Run()
+	if lobby.chatRooms["games"] != chatRoom {
+		t.Fatal("room used since its warning was archived")
+	}
+
+	clock.now = chatRoom.expiry
+	lobby.scheduler.Run()
+	if lobby.chatRooms["games"] != nil || lobby.archives["games"] != chatRoom {
+		t.Fatal("quiet room was not archived")
+	}
+}
+
+func TestArchivedRoomRestoredAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(dir, clock)
+	testAccounts(t, lobby, "alice", "bob")
+	alice := testClient(lobby, "alice", "alice")
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.SendMessage(NewMessage(clock.now, alice, "first"))
+	lobby.SendMessage(NewMessage(clock.now, alice, "second"))
+	clock.now = clock.now.Add(EXPIRY_TIME)
+	lobby.scheduler.Run()
+	if lobby.archives["games"] == nil {
+		t.Fatal("room was not archived")
+	}
+
+	lobby = testLobby(dir, clock)
+	chatRoom := lobby.archives["games"]
+	if chatRoom == nil {
+		t.Fatal("archive was not restored")
+	}
+	bob := testClient(lobby, "bob", "bob")
+	lobby.RestoreChatRoom(bob, "games")
+	if lobby.chatRooms["games"] != nil {
+		t.Fatal("someone other than the creator restored the room")
+	}
+	alice = testClient(lobby, "alice", "alice")
+	lobby.RestoreChatRoom(alice, "games")
+	if lobby.chatRooms["games"] != chatRoom {
+		t.Fatal("creator could not restore the room")
+	}
+	texts := []string{}
+	for _, frame := range chatRoom.messages {
+		if frame.Type == FRAME_MSG {
+			texts = append(texts, frame.Payload)
+		}
+	}
+	if len(texts) != 2 || texts[0] != "first" || texts[1] != "second" {
+		t.Fatalf("restored history %q, want first and second", texts)
+	}
+}
+
+func TestArchivesArePurged(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(dir, clock)
+	guest := testClient(lobby, "new_user1", "")
+	for i := 0; i <= MAX_ARCHIVES; i++ {
+		lobby.CreateChatRoom(guest, fmt.Sprintf("room%d", i), "")
+		clock.now = clock.now.Add(time.Minute)
+	}
+	clock.now = clock.now.Add(EXPIRY_TIME)
+	lobby.scheduler.Run()
+	if len(lobby.archives) != MAX_ARCHIVES || lobby.archives["room0"] != nil {
+		t.Fatalf("%d archives kept, want the oldest dropped to leave %d", len(lobby.archives), MAX_ARCHIVES)
+	}
+
+	clock.now = clock.now.Add(ARCHIVE_TIME)
+	lobby.scheduler.Run()
+	if len(lobby.archives) != 0 {
+		t.Fatalf("%d archives outlived ARCHIVE_TIME", len(lobby.archives))
+	}
+	lobby = testLobby(dir, clock)
+	if len(lobby.archives) != 0 {
+		t.Fatal("purged archives came back after a restart")
+	}
+}
+
+func TestIRCKeepalivesDontCountAsActivity(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	client := testClient(lobby, "new_user1", "")
+	server, remote := net.Pipe()
+	defer remote.Close()
+	client.conn = server
+	client.reader = bufio.NewReader(server)
+	client.protocol = PROTO_IRC
+	start := time.Now().Add(-time.Hour)
+	client.lastRead = start
+	go client.Read()
+
+	fmt.Fprint(remote, "PING :irc.example\r\nPONG :irc.example\r\n")
+	<-client.incoming
+	<-client.incoming
+	if !client.LastRead().Equal(start) {
+		t.Fatal("PING and PONG reset the idle time")
+	}
+	fmt.Fprint(remote, "PRIVMSG #games :hi\r\n")
+	<-client.incoming
+	if !client.LastRead().After(start) {
+		t.Fatal("a message did not reset the idle time")
+	}
+}
+
+func TestRoomPasswordsCheckedOffTheLobbyThread(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	testAccounts(t, lobby, "alice", "bob")
+	alice := testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	lobby.CreateChatRoom(alice, "vault", "hunter22")
+	if lobby.chatRooms["vault"] != nil {
+		t.Fatal("room opened before its password was hashed")
+	}
+	lobby.FinishLogin(<-lobby.logins)
+	chatRoom := lobby.chatRooms["vault"]
+	if chatRoom == nil || strings.Count(chatRoom.secret, "$") != 2 {
+		t.Fatalf("private room not opened with a PBKDF2 secret: %+v", chatRoom)
+	}
+
+	lobby.JoinChatRoom(bob, "vault", "wrong")
+	lobby.FinishLogin(<-lobby.logins)
+	if chatRoom.Present(bob) {
+		t.Fatal("wrong password let them in")
+	}
+	clock.now = clock.now.Add(LOGIN_BACKOFF)
+	lobby.JoinChatRoom(bob, "vault", "hunter22")
+	lobby.FinishLogin(<-lobby.logins)
+	if !chatRoom.Present(bob) {
+		t.Fatal("right password did not let them in")
+	}
+}
+
+func TestOldRoomSecretsStillWork(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	hash := sha256.Sum256(append(salt, "hunter22"...))
+	secret := hex.EncodeToString(salt) + "$" + hex.EncodeToString(hash[:])
+	if !CheckSecret(secret, "hunter22") || CheckSecret(secret, "hunter23") {
+		t.Fatal("salted SHA-256 secrets from old journals are not checked right")
+	}
+}
+
+func TestJournalSurvivesTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, JOURNAL_FILE)
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(dir, clock)
+	testAccounts(t, lobby, "alice", "bob")
+	alice := testClient(lobby, "alice", "alice")
+	bob := testClient(lobby, "bob", "bob")
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(bob, "games", "")
+	lobby.Topic(alice, "chess")
+	lobby.AddModerator(lobby.chatRooms["games"], bob)
+	lobby.SendMessage(NewMessage(clock.now, alice, "first"))
+	if err := lobby.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash halfway through writing the next entry
+	data, _ := json.Marshal(&JournalEntry{Op: JOURNAL_MESSAGE, Room: "games", Time: clock.now})
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(data[:len(data)/2])
+	file.Close()
+
+	lobby = testLobby(dir, clock)
+	chatRoom := lobby.chatRooms["games"]
+	if chatRoom == nil {
+		t.Fatal("room was not restored")
+	}
+	if chatRoom.topic != "chess" || !chatRoom.moderators["bob"] || chatRoom.owner != "alice" {
+		t.Fatal("room lost its topic, owner or moderators")
+	}
+	alice = testClient(lobby, "alice", "alice")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.SendMessage(NewMessage(clock.now, alice, "second"))
+	if err := lobby.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{}
+	for _, entry := range entries {
+		if entry.Op == JOURNAL_MESSAGE && entry.Frame == nil {
+			t.Fatal("the damaged entry was written back")
+		}
+		if entry.Op == JOURNAL_MESSAGE && entry.Frame.Type == FRAME_MSG {
+			texts = append(texts, entry.Frame.Payload)
+		}
+	}
+	if len(texts) != 2 || texts[0] != "first" || texts[1] != "second" {
+		t.Fatalf("journal has messages %q, want first and second", texts)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"general", "general", 0},
+		{"general", "genral", 1},
+		{"general", "generel", 1},
+		{"general", "generals", 1},
+		{"genreal", "general", 2},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+		{"dev", "ops", 3},
+	}
+	for _, test := range tests {
+		if got := Levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("Levenshtein(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSuggestScalesWithLength(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	alice := testClient(lobby, "alice", "")
+	for _, name := range []string{"dev", "ops", "general", "announcements-archive"} {
+		lobby.CreateChatRoom(alice, name, "")
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"dex", "dev"},
+		{"do", ""},             // two edits from "dev" is too many for a short name
+		{"dug", ""},            // likewise
+		{"gneral", "general"},  // missing a letter
+		{"genreal", "general"}, // swapped letters, two edits
+		{"anouncements-achive", "announcements-archive"},
+		{"Gen", "general"},
+	}
+	for _, test := range tests {
+		got := lobby.Suggest(alice, test.name)
+		if test.want == "" && len(got) > 0 || test.want != "" && (len(got) == 0 || got[0] != test.want) {
+			t.Errorf("Suggest(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResumeAfterActiveRoomArchived(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	lobby.resumeGrace = time.Hour
+	alice := testClient(lobby, "alice", "")
+	alice.token = "token"
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.CreateChatRoom(alice, "chess", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "chess", "")
+	lobby.Leave(alice)
+
+	chess := lobby.chatRooms["chess"]
+	chess.expiry = clock.now
+	lobby.DeleteChatRoom(chess)
+	if lobby.archives["chess"] == nil {
+		t.Fatal("room was not archived")
+	}
+
+	back := testClient(lobby, "new_user1", "")
+	lobby.Resume(back, "token")
+	if back.chatRoom != lobby.chatRooms["games"] {
+		t.Fatal("resumed without a room to talk in")
+	}
+	// used to panic with rooms but no active one
+	lobby.Switch(back, "")
+}
+
+func TestSwitchAndForget(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	alice := testClient(lobby, "alice", "")
+	lobby.Switch(alice, "")
+	lobby.CreateChatRoom(alice, "games", "")
+	lobby.CreateChatRoom(alice, "chess", "")
+	lobby.CreateChatRoom(alice, "dev", "")
+	lobby.JoinChatRoom(alice, "games", "")
+	lobby.JoinChatRoom(alice, "chess", "")
+	lobby.JoinChatRoom(alice, "dev", "")
+	games, chess, dev := lobby.chatRooms["games"], lobby.chatRooms["chess"], lobby.chatRooms["dev"]
+	if alice.chatRoom != dev || len(alice.chatRooms) != 3 {
+		t.Fatal("joining did not add the room and make it active")
+	}
+
+	lobby.Switch(alice, "games")
+	if alice.chatRoom != games {
+		t.Fatal("switch did not change the active room")
+	}
+	lobby.Switch(alice, "nowhere")
+	if alice.chatRoom != games {
+		t.Fatal("switching to a room they are not in changed the active room")
+	}
+
+	alice.Forget(chess)
+	if alice.chatRoom != games || alice.Room("chess") != nil {
+		t.Fatal("forgetting another room changed the active one")
+	}
+	alice.Forget(games)
+	if alice.chatRoom != dev {
+		t.Fatal("forgetting the active room did not fall back to the newest")
+	}
+	alice.Forget(dev)
+	if alice.chatRoom != nil || len(alice.chatRooms) != 0 {
+		t.Fatal("forgetting the last room left one active")
+	}
+
+	// rooms but none active, the listing must not assume one
+	alice.chatRooms = []*ChatRoom{games}
+	lobby.Switch(alice, "")
+	frame := <-alice.outgoing
+	for len(alice.outgoing) > 0 {
+		frame = <-alice.outgoing
+	}
+	if !strings.Contains(frame.Payload, CMD_SWITCH) {
+		t.Fatalf("listing without an active room said %q", frame.Payload)
+	}
+}
+
+// a connection that hands out the given reads one at a time and keeps what is written
+type testConn struct {
+	net.Conn
+	reads   [][]byte
+	written bytes.Buffer
+}
+
+func (conn *testConn) Read(data []byte) (int, error) {
+	if len(conn.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(data, conn.reads[0])
+	conn.reads[0] = conn.reads[0][n:]
+	if len(conn.reads[0]) == 0 {
+		conn.reads = conn.reads[1:]
+	}
+	return n, nil
+}
+
+func (conn *testConn) Write(data []byte) (int, error) {
+	return conn.written.Write(data)
+}
+
+func TestTelnetInput(t *testing.T) {
+	iac := func(b ...byte) string { return string(append([]byte{TELNET_IAC}, b...)) }
+	naws := iac(TELNET_SB, TELNET_NAWS, 0, 80, 0, 24) + iac(TELNET_SE)
+	tests := []struct {
+		name  string
+		reads []string
+		want  string
+		width int
+	}{
+		{"crlf", []string{"hi\r\n"}, "hi\n", 0},
+		{"lf", []string{"hi\n"}, "hi\n", 0},
+		{"cr nul", []string{"hi\r\x00there\r\n"}, "hi\nthere\n", 0},
+		{"backspace", []string{"hx\bi\r\n"}, "hi\n", 0},
+		{"delete", []string{"hx\x7fi\r\n"}, "hi\n", 0},
+		{"backspace past start", []string{"\b\bhi\n"}, "hi\n", 0},
+		{"backspace utf-8", []string{"caf\xc3\xa9\x7fe\n"}, "cafe\n", 0},
+		{"erase character", []string{"ab" + iac(TELNET_EC) + "\n"}, "a\n", 0},
+		{"erase line", []string{"abc" + iac(TELNET_EL) + "hi\n"}, "hi\n", 0},
+		{"control characters", []string{"a\x01b\tc\x1b\n"}, "ab\tc\n", 0},
+		{"escaped iac", []string{"a" + iac(TELNET_IAC) + "b\n"}, "a\xffb\n", 0},
+		{"escaped iac split", []string{"a" + iac(), iac() + "b\n"}, "a\xffb\n", 0},
+		{"options dropped", []string{"a" + iac(TELNET_WILL, TELNET_NAWS) + iac(TELNET_DO, TELNET_ECHO) + "b\n"}, "ab\n", 0},
+		{"naws", []string{naws + "hi\n"}, "hi\n", 80},
+		{"naws split", []string{"a" + naws[:4], naws[4:8], naws[8:] + "b\n"}, "ab\n", 80},
+		{"naws escaped iac", []string{iac(TELNET_SB, TELNET_NAWS, 0, TELNET_IAC, TELNET_IAC, 0, 24) + iac(TELNET_SE) + "\n"}, "\n", 255},
+		{"naws too short", []string{iac(TELNET_SB, TELNET_NAWS, 0, 80) + iac(TELNET_SE) + "\n"}, "\n", 0},
+	}
+	for _, test := range tests {
+		raw := &testConn{}
+		for _, read := range test.reads {
+			raw.reads = append(raw.reads, []byte(read))
+		}
+		conn := NewTelnetConn(raw, false)
+		got, _ := ioutil.ReadAll(conn)
+		if string(got) != test.want {
+			t.Errorf("%s: read %q, want %q", test.name, got, test.want)
+		}
+		if conn.Width() != test.width {
+			t.Errorf("%s: width %d, want %d", test.name, conn.Width(), test.width)
+		}
+	}
+}
+
+func TestTelnetOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		telnet bool
+		width  int
+		echo   bool
+		line   string
+		write  string
+		want   string
+	}{
+		{"not telnet", false, 5, false, "", "abcdefgh\n", "abcdefgh\n"},
+		{"crlf", true, 0, false, "", "a\nb\n", "a\r\nb\r\n"},
+		{"no width", true, 0, false, "", "abcdefgh\n", "abcdefgh\r\n"},
+		{"wrap", true, 5, false, "", "abcdefgh\n", "abcde\r\nfgh\r\n"},
+		{"exact width", true, 4, false, "", "abcd\nef\n", "abcd\r\nef\r\n"},
+		{"wrap utf-8", true, 3, false, "", "\u00e9\u00e9\u00e9\u00e9\n", "\u00e9\u00e9\u00e9\r\n\u00e9\r\n"},
+		{"escaped iac", true, 0, false, "", "a\xffb", "a\xff\xffb"},
+		{"redraw typing", true, 0, true, "ty", "hi\n", "\r\nhi\r\nty"},
+		{"no redraw without echo", true, 0, false, "ty", "hi\n", "hi\r\n"},
+	}
+	for _, test := range tests {
+		raw := &testConn{}
+		conn := NewTelnetConn(raw, false)
+		conn.telnet, conn.width, conn.echo, conn.line = test.telnet, test.width, test.echo, []byte(test.line)
+		conn.Write([]byte(test.write))
+		if raw.written.String() != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.name, raw.written.String(), test.want)
+		}
+	}
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	iac := func(b ...byte) string { return string(append([]byte{TELNET_IAC}, b...)) }
+	tests := []struct {
+		name   string
+		active bool
+		read   string
+		want   string // everything written, including the opening offers
+		echo   bool
+	}{
+		{"offers", true, "", iac(TELNET_WILL, TELNET_ECHO) + iac(TELNET_WILL, TELNET_SGA) + iac(TELNET_DO, TELNET_NAWS), false},
+		{"offer accepted", true, iac(TELNET_DO, TELNET_ECHO) + iac(TELNET_WILL, TELNET_NAWS),
+			iac(TELNET_WILL, TELNET_ECHO) + iac(TELNET_WILL, TELNET_SGA) + iac(TELNET_DO, TELNET_NAWS), true},
+		{"asked to echo", false, iac(TELNET_DO, TELNET_ECHO), iac(TELNET_WILL, TELNET_ECHO), true},
+		{"echoes typing", false, iac(TELNET_DO, TELNET_ECHO) + "a\bb\r\n", iac(TELNET_WILL, TELNET_ECHO) + "a\b \bb\r\n", true},
+		{"unknown option", false, iac(TELNET_DO, 24) + iac(TELNET_WILL, 24), iac(TELNET_WONT, 24) + iac(TELNET_DONT, 24), false},
+		{"echo turned off", true, iac(TELNET_DO, TELNET_ECHO) + iac(TELNET_DONT, TELNET_ECHO),
+			iac(TELNET_WILL, TELNET_ECHO) + iac(TELNET_WILL, TELNET_SGA) + iac(TELNET_DO, TELNET_NAWS) + iac(TELNET_WONT, TELNET_ECHO), false},
+		{"refusal not answered", false, iac(TELNET_WONT, TELNET_NAWS) + iac(TELNET_DONT, TELNET_SGA), "", false},
+	}
+	for _, test := range tests {
+		raw := &testConn{reads: [][]byte{[]byte(test.read + "\n")}}
+		conn := NewTelnetConn(raw, test.active)
+		ioutil.ReadAll(conn)
+		got := raw.written.String()
+		if conn.echo {
+			// the newline ending the read is echoed as well
+			got = strings.TrimSuffix(got, "\r\n")
+		}
+		if got != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.name, got, test.want)
+		}
+		if conn.echo != test.echo {
+			t.Errorf("%s: echo %v, want %v", test.name, conn.echo, test.echo)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	tests := []struct {
+		args     string
+		protocol int
+		hello    string // empty when it should be refused
+	}{
+		{"json", PROTO_JSON, "json 1"},
+		{"json 1", PROTO_JSON, "json 1"},
+		{"json 7", PROTO_JSON, "json 1"}, // clamped to what the server speaks
+		{"json 0", PROTO_PLAIN, ""},
+		{"json -1", PROTO_PLAIN, ""},
+		{"json one", PROTO_PLAIN, ""},
+		{"plain", PROTO_PLAIN, "plain"},
+		{"plain 1", PROTO_PLAIN, ""},
+		{"xml", PROTO_PLAIN, ""},
+		{"", PROTO_PLAIN, ""},
+	}
+	for _, test := range tests {
+		client := testClient(lobby, "alice", "")
+		client.Negotiate(strings.Fields(test.args))
+		frame := <-client.outgoing
+		if client.Protocol() != test.protocol {
+			t.Errorf("/proto %s: protocol %d, want %d", test.args, client.Protocol(), test.protocol)
+		}
+		switch {
+		case test.hello == "" && (frame.Type != FRAME_ERROR || frame.Payload != strings.TrimSuffix(ERROR_PROTO, "\n")):
+			t.Errorf("/proto %s: got %s %q, want it refused", test.args, frame.Type, frame.Payload)
+		case test.hello != "" && (frame.Type != FRAME_HELLO || frame.Payload != test.hello):
+			t.Errorf("/proto %s: got %s %q, want hello %q", test.args, frame.Type, frame.Payload, test.hello)
+		}
+	}
+}
+
+func TestJSONFrames(t *testing.T) {
+	server, remote := net.Pipe()
+	client := NewClient(server, PROTO_JSON)
+	lines := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	receive := func() *Frame {
+		frame := &Frame{}
+		if err := json.Unmarshal([]byte(<-lines), frame); err != nil {
+			t.Fatal("server sent a line that is not a frame:", err)
+		}
+		return frame
+	}
+
+	for _, bad := range []string{"not json", `{"type":"notice","payload":"hi"}`, `{"type":"","payload":"hi"}`, `["msg"]`} {
+		remote.Write([]byte(bad + "\n"))
+		frame := receive()
+		if frame.Type != FRAME_ERROR || frame.Payload != strings.TrimSuffix(ERROR_FRAME, "\n") {
+			t.Errorf("%s: got %s %q, want a malformed frame error", bad, frame.Type, frame.Payload)
+		}
+	}
+
+	remote.Write([]byte(`{"v":1,"type":"msg","payload":"/help"}` + "\n"))
+	message := <-client.incoming
+	if message.text != "/help" || !message.raw {
+		t.Errorf("msg frame came in as %q, raw %v", message.text, message.raw)
+	}
+	remote.Write([]byte(`{"v":1,"type":"cmd","payload":"/help"}` + "\n"))
+	message = <-client.incoming
+	if message.text != "/help" || message.raw {
+		t.Errorf("cmd frame came in as %q, raw %v", message.text, message.raw)
+	}
+
+	first := NewFrame(FRAME_NOTICE, SERVER_NAME, "hello\n")
+	first.Room = "games"
+	client.outgoing <- first
+	client.outgoing <- NewFrame(FRAME_INFO, SERVER_NAME, "list")
+	frame, next := receive(), receive()
+	if frame.Version != PROTO_VERSION || frame.Type != FRAME_NOTICE || frame.Room != "games" || frame.Payload != "hello" {
+		t.Errorf("sent %+v", frame)
+	}
+	if next.Id <= frame.Id {
+		t.Errorf("frame ids went from %d to %d", frame.Id, next.Id)
+	}
+	client.Quit()
+}
+
+// everything queued for the client, without waiting
+func testFrames(client *Client) []*Frame {
+	frames := []*Frame{}
+	for len(client.outgoing) > 0 {
+		frames = append(frames, <-client.outgoing)
+	}
+	return frames
+}
+
+func TestHistoryTrimming(t *testing.T) {
+	tests := []struct {
+		name     string
+		history  HistoryConfig
+		payloads []string
+		want     []string
+	}{
+		{"no limits", HistoryConfig{}, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"count", HistoryConfig{MaxMessages: 3}, []string{"a", "b", "c", "d", "e"}, []string{"c", "d", "e"}},
+		{"count exact", HistoryConfig{MaxMessages: 3}, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"bytes", HistoryConfig{MaxBytes: 5}, []string{"aa", "bb", "cc"}, []string{"bb", "cc"}},
+		{"bytes exact", HistoryConfig{MaxBytes: 6}, []string{"aa", "bb", "cc"}, []string{"aa", "bb", "cc"}},
+		{"one too big", HistoryConfig{MaxBytes: 3}, []string{"a", "toolong"}, []string{"toolong"}},
+		{"both", HistoryConfig{MaxMessages: 10, MaxBytes: 4}, []string{"aa", "b", "cc"}, []string{"b", "cc"}},
+	}
+	for _, test := range tests {
+		history := test.history
+		chatRoom := &ChatRoom{history: &history}
+		for _, payload := range test.payloads {
+			chatRoom.Record(NewFrame(FRAME_MSG, "alice", payload))
+		}
+		got, bytes := []string{}, 0
+		for _, frame := range chatRoom.messages {
+			got = append(got, frame.Payload)
+			bytes += len(frame.Payload)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: kept %q, want %q", test.name, got, test.want)
+		}
+		if chatRoom.bytes != bytes {
+			t.Errorf("%s: counted %d bytes, kept %d", test.name, chatRoom.bytes, bytes)
+		}
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	lobby := testLobby(t.TempDir(), clock)
+	chatRoom := &ChatRoom{history: &HistoryConfig{MaxMessages: 5}}
+	ids := map[string]uint64{}
+	for _, payload := range []string{"old", "a", "b", "c", "d", "e"} {
+		frame := NewFrame(FRAME_MSG, "alice", payload)
+		ids[payload] = frame.Id
+		chatRoom.Record(frame)
+	}
+	// "old" has been trimmed, "a" is the oldest kept
+
+	more := func(n int) string { return strings.TrimSuffix(fmt.Sprintf(NOTICE_HISTORY_MORE, n), "\n") }
+	end := strings.TrimSuffix(NOTICE_HISTORY_END, "\n")
+	tests := []struct {
+		name   string
+		before uint64
+		n      int
+		want   []string // payloads, then any notice
+		cursor uint64   // where /history carries on from
+	}{
+		{"newest", 0, 2, []string{"d", "e", more(3)}, ids["d"]},
+		{"next page", ids["d"], 2, []string{"b", "c", more(1)}, ids["b"]},
+		{"short last page", ids["b"], 2, []string{"a"}, ids["a"]},
+		{"past the oldest", ids["a"], 2, []string{end}, 0},
+		{"trimmed cursor", ids["old"], 2, []string{end}, 0},
+		{"before the newest", ids["e"], 10, []string{"a", "b", "c", "d"}, ids["a"]},
+		{"before is newer than everything", ids["e"] + 100, 2, []string{"d", "e", more(3)}, ids["d"]},
+		{"no page size", ids["c"], 0, []string{"a", "b"}, ids["a"]},
+	}
+	for _, test := range tests {
+		client := testClient(lobby, "bob", "")
+		chatRoom.Replay(client, test.before, test.n)
+		got := []string{}
+		for _, frame := range testFrames(client) {
+			got = append(got, frame.Payload)
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: sent %q, want %q", test.name, got, test.want)
+		}
+		if client.before != test.cursor {
+			t.Errorf("%s: carries on from %d, want %d", test.name, client.before, test.cursor)
+		}
+	}
+
+	// /history pages from where the last one stopped until there is nothing left
+	lobby.history.Replay = 2
+	client := testClient(lobby, "carol", "")
+	client.chatRoom = chatRoom
+	chatRoom.Replay(client, 0, 2)
+	testFrames(client)
+	for _, want := range []string{"b,c", "a", ""} {
+		lobby.History(client, nil)
+		got := []string{}
+		for _, frame := range testFrames(client) {
+			if frame.Type == FRAME_MSG {
+				got = append(got, frame.Payload)
+			}
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("/history sent %q, want %q", got, want)
+		}
+	}
+	lobby.History(client, nil)
+	if frames := testFrames(client); len(frames) != 1 || frames[0].Payload != end {
+		t.Error("/history after the oldest message did not say there are no more")
+	}
+	for _, args := range []string{"x", "5 0", "5 x", "-1"} {
+		lobby.History(client, strings.Fields(args))
+		if frames := testFrames(client); len(frames) != 1 || frames[0].Type != FRAME_ERROR {
+			t.Errorf("/history %s was not refused", args)
+		}
+	}
+}